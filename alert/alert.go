@@ -0,0 +1,288 @@
+package alert
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+const (
+	// Defaults for unset config values
+	DefaultRateLimit   = 5
+	DefaultWindow      = 10 * time.Minute
+	DefaultDedupWindow = time.Hour
+	DefaultDigestLines = 10
+
+	// Longest message quoted in a digest line
+	MaxLineLength = 200
+)
+
+var (
+	// numbers, hex ids and the like vary between otherwise identical messages
+	regexVariable = regexp.MustCompile(`[0-9a-fA-F]*[0-9][0-9a-fA-F]*`)
+)
+
+// Config defines which log events raise alerts and how often. It's stored as JSON in the
+// 'fabrik.alert.rules' parameter. Rules are evaluated in order, the first match deciding
+// an event's fate. Without rules, every event alerts.
+type Config struct {
+	Rules       []Rule `json:"rules"`
+	RateLimit   int    `json:"rate_limit"`
+	Window      string `json:"window"`
+	DedupWindow string `json:"dedup_window"`
+	DigestLines int    `json:"digest_lines"`
+
+	window      time.Duration
+	dedupWindow time.Duration
+}
+
+// Rule matches log events by logrus level, JSON field values and the raw message.
+// Every given condition must match. Excluding rules drop the events they match.
+type Rule struct {
+	Name    string            `json:"name"`
+	Levels  []string          `json:"levels"`
+	Fields  map[string]string `json:"fields"`
+	Pattern string            `json:"pattern"`
+	Exclude bool              `json:"exclude"`
+
+	fields  map[string]*regexp.Regexp
+	pattern *regexp.Regexp
+}
+
+// Entry is a log event, with the fields of JSON (logrus) output.
+type Entry struct {
+	Message string
+	Level   string
+	Text    string
+	Fields  map[string]interface{}
+}
+
+// Alert is a distinct alerting message, and how many times it was seen.
+type Alert struct {
+	Rule        string
+	Entry       Entry
+	Fingerprint string
+	Count       int
+}
+
+// Load reads the alert config from the secure store, validating it and applying defaults.
+func Load(store types.SecureStore) (Config, error) {
+	raw, err := store.Get(types.KeyAlertRules)
+	if err != nil {
+		return Config{}, err
+	}
+
+	var config Config
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return Config{}, fmt.Errorf("%s: %s", types.KeyAlertRules, err.Error())
+	}
+
+	if err := config.Init(); err != nil {
+		return Config{}, fmt.Errorf("%s: %s", types.KeyAlertRules, err.Error())
+	}
+
+	return config, nil
+}
+
+// Init compiles the config's rules and applies defaults.
+func (c *Config) Init() error {
+	if c.RateLimit <= 0 {
+		c.RateLimit = DefaultRateLimit
+	}
+
+	if c.DigestLines <= 0 {
+		c.DigestLines = DefaultDigestLines
+	}
+
+	var err error
+	if c.window, err = duration(c.Window, DefaultWindow); err != nil {
+		return fmt.Errorf("window: %s", err.Error())
+	}
+
+	if c.dedupWindow, err = duration(c.DedupWindow, DefaultDedupWindow); err != nil {
+		return fmt.Errorf("dedup_window: %s", err.Error())
+	}
+
+	for i := range c.Rules {
+		rule := &c.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule-%d", i)
+		}
+
+		if rule.Pattern != "" {
+			if rule.pattern, err = regexp.Compile(rule.Pattern); err != nil {
+				return fmt.Errorf("rules[%d].pattern: %s", i, err.Error())
+			}
+		}
+
+		rule.fields = make(map[string]*regexp.Regexp)
+		for field, pattern := range rule.Fields {
+			if rule.fields[field], err = regexp.Compile(pattern); err != nil {
+				return fmt.Errorf("rules[%d].fields.%s: %s", i, field, err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Default returns the config used when none is stored, where every event alerts.
+func Default() Config {
+	config := Config{}
+	config.Init()
+
+	return config
+}
+
+// RateWindow is the window notifications per stream are limited within.
+func (c Config) RateWindow() time.Duration {
+	return c.window
+}
+
+// DedupPeriod is the time an identical message is suppressed for, after alerting.
+func (c Config) DedupPeriod() time.Duration {
+	return c.dedupWindow
+}
+
+// Parse reads a log event, extracting the level, message and fields of JSON output.
+// Other output is kept as the message text.
+func Parse(message string) Entry {
+	entry := Entry{Message: message, Text: message}
+
+	var fields map[string]interface{}
+	if err := json.Unmarshal([]byte(message), &fields); err != nil {
+		return entry
+	}
+
+	entry.Fields = fields
+	if level, ok := fields["level"].(string); ok {
+		entry.Level = level
+	}
+
+	if text, ok := fields["msg"].(string); ok {
+		entry.Text = text
+	}
+
+	return entry
+}
+
+// Evaluate groups the entries which raise alerts by fingerprint, in order of first occurrence.
+func (c Config) Evaluate(entries []Entry) []Alert {
+	alerts := make([]Alert, 0)
+	index := make(map[string]int)
+
+	for _, entry := range entries {
+		rule, ok := c.match(entry)
+		if !ok {
+			continue
+		}
+
+		fingerprint := Fingerprint(rule, entry)
+		if i, seen := index[fingerprint]; seen {
+			alerts[i].Count++
+			continue
+		}
+
+		index[fingerprint] = len(alerts)
+		alerts = append(alerts, Alert{Rule: rule, Entry: entry, Fingerprint: fingerprint, Count: 1})
+	}
+
+	return alerts
+}
+
+// Fingerprint identifies repeats of a message, ignoring the numbers and ids within it.
+func Fingerprint(rule string, entry Entry) string {
+	normalized := regexVariable.ReplaceAllString(entry.Text, "#")
+	sum := sha1.Sum([]byte(rule + "\x00" + entry.Level + "\x00" + normalized))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// Digest summarizes several alerts in one message, most frequent first.
+func Digest(alerts []Alert, lines int) string {
+	sorted := make([]Alert, len(alerts))
+	copy(sorted, alerts)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Count > sorted[j].Count
+	})
+
+	text := make([]string, 0)
+	for i, alert := range sorted {
+		if i == lines {
+			text = append(text, fmt.Sprintf("...and %d more", len(sorted)-lines))
+			break
+		}
+
+		line := alert.Entry.Text
+		if runes := []rune(line); len(runes) > MaxLineLength {
+			line = string(runes[:MaxLineLength-3]) + "..."
+		}
+
+		text = append(text, fmt.Sprintf("(%dx) [%s] %s", alert.Count, alert.Rule, line))
+	}
+
+	return strings.Join(text, "\n")
+}
+
+//
+// Helpers
+//
+
+// match returns the name of the first rule matching the entry, and whether it alerts.
+func (c Config) match(entry Entry) (string, bool) {
+	if len(c.Rules) == 0 {
+		return "all", true
+	}
+
+	for _, rule := range c.Rules {
+		if rule.matches(entry) {
+			return rule.Name, !rule.Exclude
+		}
+	}
+
+	return "", false
+}
+
+func (r Rule) matches(entry Entry) bool {
+	if len(r.Levels) > 0 && !contains(r.Levels, entry.Level) {
+		return false
+	}
+
+	if r.pattern != nil && !r.pattern.MatchString(entry.Message) {
+		return false
+	}
+
+	for field, pattern := range r.fields {
+		value, ok := entry.Fields[field]
+		if !ok || !pattern.MatchString(fmt.Sprint(value)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func duration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+
+	return time.ParseDuration(value)
+}
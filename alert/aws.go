@@ -0,0 +1,61 @@
+package alert
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// AWSThrottle counts uses of a key per fixed window in a DynamoDB table, keyed by 'id'.
+// Counters expire with the table's 'ttl' attribute once their window has passed.
+type AWSThrottle struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+func NewAWSThrottle(session *session.Session, table string) *AWSThrottle {
+	return &AWSThrottle{
+		client: dynamodb.New(session),
+		table:  table,
+	}
+}
+
+// Allow counts a use of the key, returning false once the limit for the current window
+// has been reached. Concurrent callers are counted atomically.
+func (t *AWSThrottle) Allow(key string, limit int, window time.Duration) (bool, error) {
+	now := time.Now()
+	start := now.Truncate(window)
+	expire := start.Add(2 * window)
+
+	_, err := t.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(t.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(key + "#" + strconv.FormatInt(start.Unix(), 10))},
+		},
+		UpdateExpression:    aws.String("ADD #count :one SET #ttl = :ttl"),
+		ConditionExpression: aws.String("attribute_not_exists(#count) OR #count < :limit"),
+		ExpressionAttributeNames: map[string]*string{
+			"#count": aws.String("count"),
+			"#ttl":   aws.String("ttl"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":one":   {N: aws.String("1")},
+			":limit": {N: aws.String(strconv.Itoa(limit))},
+			":ttl":   {N: aws.String(strconv.FormatInt(expire.Unix(), 10))},
+		},
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return true, nil
+}
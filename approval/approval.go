@@ -0,0 +1,193 @@
+package approval
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	// Slack interactive message callback
+	CallbackId = "fabrik_approval"
+
+	// Button names, which decide the result
+	ActionApprove = "approve"
+	ActionReject  = "reject"
+
+	// Webhook request headers, mirroring Slack's signing scheme
+	SignatureHeader = "X-Fabrik-Signature"
+	TimestampHeader = "X-Fabrik-Request-Timestamp"
+
+	// Signed requests older than this are rejected, preventing replays
+	MaxRequestAge = 5 * time.Minute
+
+	signatureVersion = "v0"
+)
+
+// WebhookRequest is posted to the approval webhook. Results are posted back to the
+// callback URL, signed with the same secret.
+type WebhookRequest struct {
+	types.ApprovalRequest
+	CallbackUrl string `json:"callback_url"`
+}
+
+// PostSlack posts an interactive approval message to a Slack channel.
+func PostSlack(token, channel string, request types.ApprovalRequest) error {
+	value, err := json.Marshal(types.ApprovalResult{
+		Pipeline: request.Pipeline,
+		Stage:    request.Stage,
+		Action:   request.Action,
+		Token:    request.Token,
+		Account:  request.Account,
+		Region:   request.Region,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	attachment := slack.Attachment{
+		Fallback:   fmt.Sprintf("Approval required for %s", request.Pipeline),
+		CallbackID: CallbackId,
+		Color:      "warning",
+		Title:      request.ReviewUrl,
+		TitleLink:  request.ReviewUrl,
+		Text:       Summary(request),
+		MarkdownIn: []string{"text"},
+		Actions: []slack.AttachmentAction{
+			slack.AttachmentAction{
+				Name:  ActionApprove,
+				Text:  "Approve",
+				Style: "primary",
+				Type:  "button",
+				Value: string(value),
+			},
+			slack.AttachmentAction{
+				Name:  ActionReject,
+				Text:  "Reject",
+				Style: "danger",
+				Type:  "button",
+				Value: string(value),
+				Confirm: &slack.ConfirmationField{
+					Title: "Reject this change?",
+					Text:  fmt.Sprintf("The %s pipeline execution will fail.", request.Pipeline),
+				},
+			},
+		},
+	}
+
+	text := fmt.Sprintf("*Approval required* for `%s` (%s / %s)", request.Pipeline, request.Stage, request.Action)
+	_, _, err = slack.New(token).PostMessage(channel, text, slack.PostMessageParameters{
+		Attachments: []slack.Attachment{attachment},
+		Markdown:    true,
+	})
+
+	return err
+}
+
+// PostWebhook posts an approval request to a generic webhook, signed with the secret.
+func PostWebhook(url, secret, callbackUrl string, request types.ApprovalRequest) error {
+	body, err := json.Marshal(WebhookRequest{ApprovalRequest: request, CallbackUrl: callbackUrl})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(TimestampHeader, timestamp)
+	req.Header.Set(SignatureHeader, Sign(secret, timestamp, body))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded %s", resp.Status)
+	}
+
+	return nil
+}
+
+// Summary describes the changes awaiting approval, one line per source revision.
+func Summary(request types.ApprovalRequest) string {
+	lines := make([]string, 0)
+	for _, source := range request.Sources {
+		message := strings.SplitN(source.Summary, "\n", 2)[0]
+		lines = append(lines, fmt.Sprintf("<https://github.com/%s/%s/commit/%s|%s/%s@%s> (%s) %s",
+			source.Owner, source.Repo, source.Revision,
+			source.Owner, source.Repo, shortHash(source.Revision),
+			source.Branch, message))
+	}
+
+	if request.CustomData != "" {
+		lines = append(lines, "", request.CustomData)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// Sign computes a request signature, i.e. 'v0=<hex hmac-sha256 of v0:timestamp:body>'.
+// Slack signs its interactive message callbacks the same way.
+func Sign(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(signatureVersion + ":" + timestamp + ":"))
+	mac.Write(body)
+
+	return signatureVersion + "=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify returns an error if the signature does not match the body, or the request is stale.
+func Verify(secret, timestamp, signature string, body []byte, now time.Time) error {
+	if signature == "" || timestamp == "" {
+		return errors.New("missing signature")
+	}
+
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("error parsing timestamp %q", timestamp)
+	}
+
+	age := now.Sub(time.Unix(seconds, 0))
+	if age > MaxRequestAge || age < -MaxRequestAge {
+		return errors.New("request timestamp outside of allowed window")
+	}
+
+	if !hmac.Equal([]byte(signature), []byte(Sign(secret, timestamp, body))) {
+		return errors.New("signature check failed")
+	}
+
+	return nil
+}
+
+//
+// Helpers
+//
+
+func shortHash(hash string) string {
+	if len(hash) < 6 {
+		return hash
+	}
+
+	return hash[:6]
+}
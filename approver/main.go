@@ -0,0 +1,225 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/ngmiller/fabrik/approval"
+	"github.com/ngmiller/fabrik/pipeline"
+	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/target"
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/nlopes/slack"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// HTTP request headers
+	slackSignatureHeader = "X-Slack-Signature"
+	slackTimestampHeader = "X-Slack-Request-Timestamp"
+)
+
+// Assumed role sessions of the deployment targets, kept while the function is warm
+var targetSessions *target.Sessions
+
+func init() {
+	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+// Handler receives approval results, from Slack's interactive message callbacks or the
+// approval webhook, verifies their signature, and approves or rejects the pipeline action.
+func Handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln("recovered from panic:", r)
+		}
+	}()
+
+	// AWS session
+	sess := session.Must(session.NewSession())
+	secureStore := secure.NewAWSSecureStore(sess)
+
+	// pipelines of deployment targets are approved through the target's role
+	targets, err := target.Load(secureStore)
+	if err != nil && !secure.NotFound(err) {
+		log.Errorln("error loading deployment targets:", err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}, nil
+	}
+
+	if targetSessions == nil {
+		targetSessions = target.NewSessions(sess, os.Getenv("ARTIFACT_STORE"))
+	}
+
+	managers := func(result types.ApprovalResult) (types.PipelineManager, error) {
+		pipelineSession, err := targetSessions.Resolve(targets, result.Account, result.Region)
+		if err != nil {
+			return nil, err
+		}
+
+		return pipeline.NewAWSPipelineManager(log.WithField("pipeline", result.Pipeline), pipelineSession), nil
+	}
+
+	body := []byte(request.Body)
+	if request.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(request.Body)
+		if err != nil {
+			return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}, nil
+		}
+
+		body = decoded
+	}
+
+	if _, ok := request.Headers[slackSignatureHeader]; ok {
+		return ProcessSlack(request.Headers, body, secureStore, managers), nil
+	}
+
+	return ProcessWebhook(request.Headers, body, secureStore, managers), nil
+}
+
+// ProcessSlack handles an approve or reject button press, replacing the original
+// message with the result.
+func ProcessSlack(headers map[string]string, body []byte, store types.SecureStore, managers func(types.ApprovalResult) (types.PipelineManager, error)) events.APIGatewayProxyResponse {
+	secret, err := store.Get(types.KeySlackSigning)
+	if err != nil {
+		log.Errorln("could not read slack signing secret:", err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+
+	err = approval.Verify(secret, headers[slackTimestampHeader], headers[slackSignatureHeader], body, time.Now())
+	if err != nil {
+		log.Errorln(err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusUnauthorized}
+	}
+
+	// interactive message payloads are form encoded json
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}
+	}
+
+	var callback slack.AttachmentActionCallback
+	if err := json.Unmarshal([]byte(form.Get("payload")), &callback); err != nil {
+		log.Errorln("json.Unmarshal:", err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}
+	}
+
+	if callback.CallbackID != approval.CallbackId || len(callback.Actions) == 0 {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}
+	}
+
+	action := callback.Actions[0]
+
+	var result types.ApprovalResult
+	if err := json.Unmarshal([]byte(action.Value), &result); err != nil {
+		log.Errorln("json.Unmarshal:", err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}
+	}
+
+	result.Approved = action.Name == approval.ActionApprove
+	result.Approver = fmt.Sprintf("%s (slack:%s)", callback.User.Name, callback.User.ID)
+
+	// the original message stays in place, without its buttons
+	message := callback.OriginalMessage
+	for i := range message.Attachments {
+		message.Attachments[i].Actions = nil
+	}
+
+	if err := process(result, managers); err != nil {
+		message.Text += fmt.Sprintf("\n:warning: could not record <@%s>'s response: %s", callback.User.ID, err.Error())
+	} else if result.Approved {
+		message.Text += fmt.Sprintf("\n:white_check_mark: Approved by <@%s>", callback.User.ID)
+	} else {
+		message.Text += fmt.Sprintf("\n:x: Rejected by <@%s>", callback.User.ID)
+	}
+
+	payload, err := json.Marshal(map[string]interface{}{
+		"replace_original": true,
+		"text":             message.Text,
+		"attachments":      message.Attachments,
+	})
+
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: http.StatusOK,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(payload),
+	}
+}
+
+// ProcessWebhook handles an approval result posted to the approval webhook's callback URL.
+func ProcessWebhook(headers map[string]string, body []byte, store types.SecureStore, managers func(types.ApprovalResult) (types.PipelineManager, error)) events.APIGatewayProxyResponse {
+	secret, err := store.Get(types.KeyWebhookSecret)
+	if err != nil {
+		log.Errorln("could not read webhook secret:", err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+
+	err = approval.Verify(secret, headers[approval.TimestampHeader], headers[approval.SignatureHeader], body, time.Now())
+	if err != nil {
+		log.Errorln(err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusUnauthorized}
+	}
+
+	var result types.ApprovalResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		log.Errorln("json.Unmarshal:", err.Error())
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusBadRequest}
+	}
+
+	if err := process(result, managers); err != nil {
+		return events.APIGatewayProxyResponse{Body: err.Error(), StatusCode: http.StatusBadRequest}
+	}
+
+	return events.APIGatewayProxyResponse{Body: "ok", StatusCode: http.StatusOK}
+}
+
+//
+// Helpers
+//
+
+// process records the approval result against the pipeline action, through the manager of
+// the pipeline's account and region.
+func process(result types.ApprovalResult, managers func(types.ApprovalResult) (types.PipelineManager, error)) error {
+	if result.Approver == "" {
+		return errors.New("approver is required")
+	}
+
+	log := log.WithFields(log.Fields{
+		"pipeline": result.Pipeline,
+		"stage":    result.Stage,
+		"action":   result.Action,
+		"approved": result.Approved,
+		"approver": result.Approver,
+	})
+
+	manager, err := managers(result)
+	if err != nil {
+		log.Errorln("error preparing deployment target:", err.Error())
+		return err
+	}
+
+	if err := manager.PutApproval(result); err != nil {
+		log.Errorln("error putting approval result:", err.Error())
+		return err
+	}
+
+	log.Infoln("approval result recorded")
+	return nil
+}
@@ -1,17 +1,29 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"os"
+	"sort"
 	"strings"
 	"time"
 
+	"github.com/ngmiller/fabrik/delivery"
+	"github.com/ngmiller/fabrik/drift"
+	"github.com/ngmiller/fabrik/filter"
+	"github.com/ngmiller/fabrik/health"
+	"github.com/ngmiller/fabrik/history"
+	"github.com/ngmiller/fabrik/job"
 	"github.com/ngmiller/fabrik/lambda"
+	"github.com/ngmiller/fabrik/notify"
+	"github.com/ngmiller/fabrik/paths"
 	"github.com/ngmiller/fabrik/repo"
 	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/semver"
 	"github.com/ngmiller/fabrik/stack"
+	"github.com/ngmiller/fabrik/target"
 	"github.com/ngmiller/fabrik/types"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -25,8 +37,25 @@ import (
 const (
 	// Execution timeout in seconds
 	ExecutionTimeout = 300
+
+	// Repository files
+	ConfigPath     = "fabrik.json"
+	PipelinePath   = "pipeline.json"
+	ParametersPath = "parameters.json"
+
+	// GitHub truncates the commit list of a push payload
+	MaxPushCommits = 20
+
+	// Time between rounds of post-deploy health checks
+	HealthCheckInterval = 10 * time.Second
 )
 
+// Assumed role sessions of the deployment targets, kept while the function is warm
+var targetSessions *target.Sessions
+
+// ErrStopped is returned by the stages of Process which were interrupted by the stop signal.
+var ErrStopped = errors.New("received stop signal")
+
 func init() {
 	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
 }
@@ -47,7 +76,7 @@ func Handler(dynamoEvent events.DynamoDBEvent) error {
 	// AWS session
 	sess := session.Must(session.NewSession())
 
-	for _, record := range dynamoEvent.Records {
+	for n, record := range dynamoEvent.Records {
 		// skip modify and remove events from dynamo
 		if record.EventName != types.DynamoDBEventInsert {
 			log.Warnln("received non INSERT event from dynamo - no action")
@@ -59,6 +88,46 @@ func Handler(dynamoEvent events.DynamoDBEvent) error {
 		eventType := item["type"].String()
 		rawEvent := []byte(item["payload"].String())
 
+		// re-run requests from the Checks API
+		if eventType == types.EventTypeCheckRun {
+			var event types.GitHubCheckRunEvent
+			if err := json.Unmarshal(rawEvent, &event); err != nil {
+				log.Errorln("json.Unmarshal", err.Error())
+				return nil
+			}
+
+			log := log.WithFields(log.Fields{
+				"check": event.CheckRun.Name,
+				"repo":  event.Repository.Name,
+			})
+
+			// pipelines of deployment targets are started through the target's role
+			managers := func(account, region string) (types.StackManager, error) {
+				targets, err := target.Load(secure.NewAWSSecureStore(sess))
+				if err != nil && !secure.NotFound(err) {
+					return nil, err
+				}
+
+				if targetSessions == nil {
+					targetSessions = target.NewSessions(sess, os.Getenv("ARTIFACT_STORE"))
+				}
+
+				stackSession, err := targetSessions.Resolve(targets, account, region)
+				if err != nil {
+					return nil, err
+				}
+
+				return stack.NewAWSStackManager(log, stackSession), nil
+			}
+
+			deliveries := delivery.NewAWSDeliveryStore(sess, os.Getenv("EVENT_TABLE"))
+			if err := Rerun(log, event, managers, deliveries, lambda.NewAWSLambdaManager(sess)); err != nil {
+				log.Errorln("error re-running pipeline:", err.Error())
+			}
+
+			continue
+		}
+
 		if eventType != types.EventTypePush {
 			log.Warnln("received non-push event:", eventType, "- no action")
 			return nil
@@ -70,18 +139,26 @@ func Handler(dynamoEvent events.DynamoDBEvent) error {
 			return nil
 		}
 
+		// the listener's delivery id, carried by prep check runs to re-run the push
+		deliveryId := ""
+		if id, ok := item["id"]; ok && id.DataType() == events.DataTypeString {
+			deliveryId = id.String()
+		}
+
+		// services left waiting on their stacks by a previous invocation
+		resumed, err := job.Resumed(item)
+		if err != nil {
+			log.Errorln("error reading resumed jobs:", err.Error())
+			return nil
+		}
+
 		log := log.WithFields(log.Fields{
 			"ref":    parseRef(event.Ref),
 			"commit": shortHash(event.After),
 			"repo":   event.Repository.Name,
+			"pusher": event.Pusher.Name,
 		})
 
-		// do nothing if branch contains NOBUILD
-		if strings.Contains(event.Ref, "NOBUILD") {
-			log.Warnln("received event ref requests no build - no action")
-			return nil
-		}
-
 		// fetch secure repo token
 		secureStore := secure.NewAWSSecureStore(sess)
 		token, err := secureStore.Get(types.KeyToken)
@@ -90,37 +167,242 @@ func Handler(dynamoEvent events.DynamoDBEvent) error {
 			return nil
 		}
 
+		// stages deployed to other accounts, or regions
+		targets, err := target.Load(secureStore)
+		if err != nil && !secure.NotFound(err) {
+			log.Errorln("error loading deployment targets:", err.Error())
+			return nil
+		}
+
 		// prepare processing dependencies
-		stackManager := stack.NewAWSStackManager(log, sess)
 		lambdaManager := lambda.NewAWSLambdaManager(sess)
+		deploymentStore := history.NewAWSDeploymentStore(sess, os.Getenv("DEPLOYMENT_TABLE"), os.Getenv("ARTIFACT_STORE"))
+		driftStore := drift.NewAWSDriftStore(sess, os.Getenv("DRIFT_TABLE"))
+
+		// stacks which outlive the invocation are resumed by their events, when they're published
+		var jobStore types.JobStore
+		if os.Getenv("STACK_TOPIC") != "" {
+			jobStore = job.NewAWSJobStore(sess, os.Getenv("JOB_TABLE"))
+		}
+
+		notifier, err := notify.Load(secureStore)
+		if err != nil {
+			log.Warnln("notifications disabled:", err.Error())
+		}
+
+		// API token, which differs from the pipeline's OAuth token when using checks
+		apiToken, err := repo.Token(secureStore, token, event.Repository.Owner.Name, event.Repository.Name)
+		if err != nil {
+			log.Errorln("error getting api token:", err.Error())
+			return nil
+		}
 
-		repo := repo.NewGitHubRepository(log, event.Repository.Owner.Name, event.Repository.Name, token)
+		repo := repo.NewGitHubRepository(log, event.Repository.Owner.Name, event.Repository.Name, apiToken)
 		shortHash := shortHash(event.After)
 
-		// status - pending
-		repo.Status(event.After, prepStatus(types.GitStatePending, shortHash))
+		// resolve the default branch, falling back to the GitHub API if it's missing from the event
+		if event.Repository.DefaultBranch == "" {
+			branch, err := repo.DefaultBranch()
+			if err != nil {
+				log.Errorln("error resolving default branch:", err.Error())
+				return nil
+			}
 
-		// wait until we get a concrete stack status
-		// or 90% of the execution timeout has been used, in which case, restart
-		stop := make(chan struct{})
-		status := Process(log, stop, event, repo, stackManager, token)
+			event.Repository.DefaultBranch = branch
+		}
 
-		select {
-		case err = <-status:
+		// stacks are managed in the stage's target, or otherwise the deployment account
+		stackSession, artifactStore := sess, os.Getenv("ARTIFACT_STORE")
+		stackTopic := os.Getenv("STACK_TOPIC")
+		jobAccount, jobRegion := "", ""
+
+		if deployTarget, ok := targets[refStage(event)]; ok {
+			log = log.WithField("target", fmt.Sprintf("%s/%s", target.Account(deployTarget), deployTarget.Region))
+
+			if targetSessions == nil {
+				targetSessions = target.NewSessions(sess, artifactStore)
+			}
+
+			stackSession, err = targetSessions.Get(deployTarget)
 			if err != nil {
-				log.Errorln("error processing event:", err.Error())
-				repo.Status(event.After, prepStatus(types.GitStateFailure, shortHash))
+				log.Errorln("error preparing deployment target:", err.Error())
+
+				failure := prepStatus("", types.GitStateFailure, shortHash)
+				failure.Description = types.StatusDescription(err.Error())
+
+				report(repo, event.After, failure, deliveryId, nil)
 				return nil
 			}
-		case <-time.After(0.9 * ExecutionTimeout * time.Second):
-			log.Infoln("execution timeout reached, restarting function!")
-			close(stop)
 
-			return lambdaManager.Invoke(lambdacontext.FunctionName, dynamoEvent)
+			artifactStore = target.ArtifactStore(deployTarget, artifactStore)
+			deploymentStore.WithTarget(target.Account(deployTarget), deployTarget.Region)
+			jobAccount, jobRegion = target.Account(deployTarget), deployTarget.Region
+
+			// the target's stack events aren't published to the deployment account's topic,
+			// its jobs are resumed by the watcher's sweep
+			stackTopic = ""
+		}
+
+		stackManager := stack.NewAWSStackManager(log, stackSession).WithTopic(stackTopic)
+		healthChecker := health.NewAWSHealthChecker(stackSession)
+
+		// load the repository's service definitions
+		config, err := repoConfig(event, repo)
+		if err != nil {
+			log.Errorln("error reading repo config:", err.Error())
+
+			failure := prepStatus("", types.GitStateFailure, shortHash)
+			failure.Description = types.StatusDescription(err.Error())
+
+			report(repo, event.After, failure, deliveryId, nil)
+			return nil
+		}
+
+		// skip or force the build according to the repository's build filters
+		changes := changedFiles(event)
+		decision, err := filter.Decide(append(config.Filters, filter.Defaults...), event, changes)
+		if err != nil {
+			log.Errorln("error evaluating build filters:", err.Error())
+			return nil
+		}
+
+		if decision != nil && decision.Action == types.FilterActionSkip {
+			log.Warnln("build filter requests no build:", decision.Reason, "- no action")
+
+			if !event.Deleted {
+				report(repo, event.After, skipStatus(decision.Reason, shortHash), deliveryId, nil)
+			}
+
+			continue
+		}
+
+		force := decision != nil && decision.Action == types.FilterActionBuild
+		if force {
+			log.Infoln("build filter forces build:", decision.Reason)
+		}
+
+		// status - pending, for each service affected by the push
+		services := affectedServices(config, changes, force)
+		if resumed != nil {
+			services = resumedServices(services, resumed)
+		}
+
+		if len(services) == 0 {
+			log.Infoln("push does not affect any service - no action")
+			continue
+		}
+
+		// deployment - in progress, for each service stack being updated
+		deployments := make([]int64, len(services))
+		for i, service := range services {
+			// resumed services already reported their status and deployment
+			if resumed != nil {
+				deployments[i] = resumedDeployment(service, resumed)
+				continue
+			}
+
+			report(repo, event.After, prepStatus(service.Name, types.GitStatePending, shortHash), deliveryId, nil)
+
+			if !event.Deleted {
+				id, err := deploy(repo, event, service, shortHash)
+				if err != nil {
+					log.Warnln("could not create deployment:", service.Name, err.Error())
+				}
+
+				deployments[i] = id
+			}
+		}
+
+		// wait until we get a concrete stack status for every service
+		// or 90% of the execution timeout has been used, in which case, suspend
+		stop := make(chan struct{})
+		statuses := make([]<-chan error, len(services))
+		for i, service := range services {
+			log := log.WithField("service", service.Name)
+			statuses[i] = Process(log, stop, event, service, repo, stackManager, healthChecker, deploymentStore, driftStore, token, artifactStore, resumed != nil)
+		}
+
+		// report the concrete status of a service, as the stage for that ref
+		finish := func(i int, err error) {
+			service := services[i]
+			stack := stackName(event, service.StackSuffix)
+
+			if err != nil {
+				log.Errorln("error processing event:", service.Name, err.Error())
+
+				failure := prepStatus(service.Name, types.GitStateFailure, shortHash)
+				failure.Description = types.StatusDescription(err.Error())
+
+				report(repo, event.After, failure, deliveryId, failureOutput(err, service, stack, stackManager))
+				notifyPrep(log, notifier, event, stack, failure, err)
+
+				if deployments[i] != 0 {
+					repo.DeploymentStatus(deployments[i], types.GitHubDeploymentStatus{
+						State:       types.DeploymentStateFailure,
+						LogUrl:      failure.TargetUrl,
+						Description: failure.Description,
+					})
+				}
+
+				return
+			}
+
+			// status - ok
+			success := prepStatus(service.Name, types.GitStateSuccess, shortHash)
+			output := successOutput(event, stack)
+			if service.StackSet != nil {
+				success.Description, output = stackSetOutput(event, stackManager, stack)
+
+				// stack sets have no pipeline to finish the deployment
+				if deployments[i] != 0 {
+					repo.DeploymentStatus(deployments[i], types.GitHubDeploymentStatus{
+						State:       types.DeploymentStateSuccess,
+						LogUrl:      success.TargetUrl,
+						Description: success.Description,
+					})
+				}
+			}
+
+			report(repo, event.After, success, deliveryId, output)
+			notifyPrep(log, notifier, event, stack, success, nil)
 		}
 
-		// status - ok
-		repo.Status(event.After, prepStatus(types.GitStateSuccess, shortHash))
+		timeout := time.After(0.9 * ExecutionTimeout * time.Second)
+		for i, status := range statuses {
+			select {
+			case err := <-status:
+				finish(i, err)
+			case <-timeout:
+				log.Infoln("execution timeout reached, suspending")
+				close(stop)
+
+				// report the services which are already done, and suspend the rest
+				jobs := make([]types.StackJob, 0, len(services)-i)
+				for j := i; j < len(services); j++ {
+					select {
+					case err := <-statuses[j]:
+						if err != ErrStopped {
+							finish(j, err)
+							continue
+						}
+					default:
+					}
+
+					jobs = append(jobs, types.StackJob{
+						Stack:      stackName(event, services[j].StackSuffix),
+						Service:    services[j].Name,
+						Deployment: deployments[j],
+						Payload:    string(rawEvent),
+						Created:    time.Now().UTC(),
+						Account:    jobAccount,
+						Region:     jobRegion,
+					})
+				}
+
+				remaining := events.DynamoDBEvent{Records: dynamoEvent.Records[n+1:]}
+				return suspend(log, jobStore, lambdaManager, jobs, remaining)
+			}
+		}
 	}
 
 	return nil
@@ -136,34 +418,49 @@ func Handler(dynamoEvent events.DynamoDBEvent) error {
 //
 // Each pipeline is parameterized via a parameters.json file in the repo. Each parameter set
 // is keyed by 'development', 'staging', and 'production' - corresponding to the CodePipeline instance
-// by the same name ('development' parameters are applied to all non master/tag refs)
+// by the same name ('development' parameters are applied to all non default branch/tag refs)
+//
+// A repository may define several pipelines (services) in a fabrik.json file, each with its own
+// template, parameters and stack suffix. Process handles a single service.
 //
 //     if ref is tag:
-//       stack = {repo}-production
-//     if ref = 'master':
-//       stack = {repo}-staging
+//       stack = {repo}-production[-{suffix}]
+//     if ref is pre-release tag (i.e. v1.2.0-rc.1):
+//       stack = {repo}-preproduction[-{suffix}]
+//     if ref = default branch:
+//       stack = {repo}-staging[-{suffix}]
 //     else:
-//       stack = {repo}-{ref}
+//       stack = {repo}-{ref}[-{suffix}]
 //
 //     if event.deleted:
 //       if not exists(stack): warn and skip
 //       else: delete stack
 //       return
 //
+//     if tag and stack exists: refuse versions lower than the deployed version
+//
 //     prepare context and set parameters
 //
 //     create or update stack with parameters
-//     if tag: call UpdatePipeline with tag
+//       (tags pin the pipeline source to the tagged commit)
 //
 //     monitor stack progress
+//     if tag and stack existed: pin pipeline source to tagged commit, monitor
 //     if stack was updated:
 //       start pipeline
 //
-func Process(log *log.Entry, stop <-chan struct{}, event types.GitHubEvent, repo types.Repository, manager types.StackManager, repoToken string) <-chan error {
-	result := make(chan error)
+func Process(log *log.Entry, stop <-chan struct{}, event types.GitHubEvent, service types.ServiceConfig, repo types.Repository, manager types.StackManager, checker types.HealthChecker, deployments types.DeploymentStore, drifts types.DriftStore, repoToken, artifactStore string, resumed bool) <-chan error {
+	// buffered, so that a result nobody waits on after a timeout doesn't block
+	result := make(chan error, 1)
 	go func() {
+		// stack sets have no pipeline, and are deployed to each of their instances
+		if service.StackSet != nil {
+			result <- ProcessStackSet(log, stop, event, service, repo, manager, resumed)
+			return
+		}
+
 		// Get stack state, delete if necessary
-		stack := stackName(event.Repository.Name, event.Ref)
+		stack := stackName(event, service.StackSuffix)
 		exists, status, err := manager.Status(stack)
 		if err != nil {
 			result <- err
@@ -182,34 +479,106 @@ func Process(log *log.Entry, stop <-chan struct{}, event types.GitHubEvent, repo
 		}
 
 		// fetch stack and parameter files from repoistory
-		// pipeline.json - CI/CD pipeline stack spec
-		// parameters.json - stack parameters
-		context, err := buildContext(event, repo, "pipeline.json", "parameters.json")
+		// pipeline - CI/CD pipeline stack spec
+		// parameters - stack parameters
+		context, err := buildContext(event, repo, service.Pipeline, service.Parameters)
 		if err != nil {
 			result <- err
 			return
 		}
 
+		// refuse to deploy a version lower than the one currently deployed
+		if exists && isTag(event) {
+			if err := checkVersion(log, event, manager, stack); err != nil {
+				result <- err
+				return
+			}
+		}
+
+		// stacks which failed to create or roll back can't be updated as they are. Resumed
+		// jobs may have been suspended while their failed stack was being deleted
+		if exists && (!resumed || status == types.StackStatusDeleteInProgress) {
+			if exists, status, err = recoverStack(log, stop, manager, stack, status, refStage(event)); err != nil {
+				result <- err
+				return
+			}
+		}
+
 		// ammend parameter list with required parameters
-		context.Parameters = append(
-			context.Parameters, requiredParameters(event, repoToken, os.Getenv("ARTIFACT_STORE"))...)
+		context.Parameters, err = declaredParameters(manager, context.PipelineTemplate,
+			append(context.Parameters, requiredParameters(event, repoToken, artifactStore)...),
+			types.ParameterVersion)
 
-		// create or update stack with ref specific parameters
-		if !exists {
+		if err != nil {
+			result <- err
+			return
+		}
+
+		// the stack as it was, to roll back to if the update turns out to be unhealthy. Resumed
+		// jobs no longer have the snapshot taken before their update, so they roll back to the
+		// last recorded deployment instead
+		var previous *snapshot
+		if resumed && exists && service.HealthCheck != nil {
+			if previous, err = lastDeployment(deployments, stack); err != nil {
+				log.Warnln("could not load the last deployment, rollback disabled:", err.Error())
+			} else if previous == nil {
+				log.Warnln("no deployment recorded for the stack, rollback disabled")
+			}
+		}
+
+		// whether this push changed the stack, rather than waiting on an operation in progress
+		deployed := resumed
+
+		// tags are built from the default branch, which must not have moved on
+		if isTag(event) && !(resumed && exists) {
+			if err := checkHead(repo, event); err != nil {
+				result <- err
+				return
+			}
+		}
+
+		// create or update stack with ref specific parameters, unless it was done
+		// by the invocation which left this job. Stacks deleted to be recovered are
+		// created again
+		if resumed && exists {
+			log.Infoln("resuming stack", stack)
+		} else if !exists {
 			// create - pipeline is started automatically when created
 			log.Infoln("stack create", stack)
 			if err := manager.Create(stack, context.Parameters, context.PipelineTemplate); err != nil {
 				result <- err
 				return
 			}
+
+			deployed = true
 		} else {
 			// only do an update if we aren't already in progress, otherwise, continue monitoring
-			if statusComplete(status) || statusFailed(status) {
+			if status.IsTerminal() && !status.CanUpdate() {
+				result <- intervention(stack, status, "stack can't be updated")
+				return
+			}
+
+			if status.CanUpdate() {
+				if service.BlockOnDrift {
+					if err := checkDrift(drifts, stack); err != nil {
+						result <- err
+						return
+					}
+				}
+
+				if service.HealthCheck != nil && status.IsSuccess() {
+					if previous, err = takeSnapshot(manager, stack); err != nil {
+						log.Warnln("could not snapshot stack, rollback disabled:", err.Error())
+					}
+				}
+
 				log.Infoln("stack update", stack)
 				if err := manager.Update(stack, context.Parameters, context.PipelineTemplate); err != nil {
 					result <- err
 					return
 				}
+
+				deployed = true
 			}
 		}
 
@@ -218,7 +587,50 @@ func Process(log *log.Entry, stop <-chan struct{}, event types.GitHubEvent, repo
 			return
 		}
 
+		// the update above is skipped while a stack operation is in progress,
+		// make sure the production source builds the default branch
+		if exists && isTag(event) {
+			log.Infoln("pin build to", event.Repository.DefaultBranch)
+			if err := manager.UpdateBuild(stack, event.Repository.DefaultBranch); err != nil {
+				result <- err
+				return
+			}
+
+			if err := Watch(log, stop, manager, stack); err != nil {
+				result <- err
+				return
+			}
+
+			deployed = true
+		}
+
+		// verify the updated stack, rolling back if it's unhealthy
+		if service.HealthCheck != nil {
+			if err := checkHealth(log, stop, *(service.HealthCheck), manager, checker, stack); err == ErrStopped {
+				result <- err
+				return
+			} else if err != nil {
+				result <- rollback(log, stop, *(service.HealthCheck), manager, stack, previous, context.Parameters, err)
+				return
+			}
+		}
+
+		// keep a record of the deployment, to roll back to later
+		if deployed {
+			if err := recordDeployment(deployments, manager, event, stack); err != nil {
+				log.Warnln("could not record deployment:", err.Error())
+			}
+		}
+
 		if exists {
+			// the default branch may have moved on while the stack was updated
+			if isTag(event) {
+				if err := checkHead(repo, event); err != nil {
+					result <- err
+					return
+				}
+			}
+
 			log.Infoln("start build")
 			if err := manager.StartBuild(stack); err != nil {
 				result <- err
@@ -232,145 +644,1205 @@ func Process(log *log.Entry, stop <-chan struct{}, event types.GitHubEvent, repo
 	return result
 }
 
-// Watch monitors the state of stack operation, returning an error if there
-// was an error in that operation. This function will continue to monitor the stack in
-// a loop until it receives a signal to stop from the given channel.
-func Watch(log *log.Entry, stop <-chan struct{}, manager types.StackManager, stack string) error {
-	for {
-		select {
-		case <-stop:
-			log.Infoln("stack monitor received stop signal")
-			return errors.New("received stop signal")
-		default:
-			_, status, err := manager.Status(stack)
-			if err != nil {
-				return err
-			}
-
-			// fail if status comes back as 'rollback' or 'failed' - something failed
-			if statusRollback(status) || statusFailed(status) {
-				log.Infoln("stack status", status)
-				return errors.New("stack rollback or failure")
-			}
+// ProcessStackSet deploys a service's template as a stack set, named like the service's stack
+// would be. The stack set is updated, then instances are created in the accounts and regions
+// added to its config. Instances removed from the config are left in place. Resumed jobs
+// wait on the latest operation instead of updating the stack set again.
+//
+// Stack sets only receive the parameters of their manifest, along with the stage and
+// version, as repository parameters aren't meant to be shared with other accounts.
+func ProcessStackSet(log *log.Entry, stop <-chan struct{}, event types.GitHubEvent, service types.ServiceConfig, repo types.Repository, manager types.StackManager, resumed bool) error {
+	name := stackName(event, service.StackSuffix)
+	config := *(service.StackSet)
 
-			// continue waiting if stack status isn't complete
-			if !statusComplete(status) {
-				log.Infoln("stack status", status)
-				time.Sleep(time.Second)
-				continue
-			}
+	exists, err := manager.StackSetExists(name)
+	if err != nil {
+		return err
+	}
 
-			log.Infoln("stack status", status)
+	if event.Deleted {
+		if !exists {
+			log.Warnln("received push/deleted event for non-existant stack set")
 			return nil
 		}
-	}
-}
 
-//
-// Helpers
-//
+		return deleteStackSet(log, stop, manager, name, config)
+	}
 
-func stackName(repo, ref string) string {
-	if refType(ref) == types.GitRefMaster {
-		return fmt.Sprintf("%s-staging", repo)
+	context, err := buildContext(event, repo, service.Pipeline, service.Parameters)
+	if err != nil {
+		return err
 	}
 
-	if refType(ref) == types.GitRefTag {
-		return fmt.Sprintf("%s-production", repo)
+	parameters, err := declaredParameters(manager, context.PipelineTemplate,
+		append(context.Parameters, stackSetParameters(event)...),
+		types.ParameterStage, types.ParameterVersion)
+
+	if err != nil {
+		return err
 	}
 
-	return fmt.Sprintf("%s-%s", repo, parseRef(ref))
-}
+	// an operation in progress must end before another starts
+	latest, err := manager.LatestStackSetOperation(name)
+	if err != nil {
+		return err
+	}
 
-func shortHash(hash string) string {
-	if len(hash) < 6 {
-		return hash
+	if latest != nil && (resumed || !latest.Done()) {
+		log.Infoln("waiting on stack set operation", latest.Id)
+		if err := WatchStackSet(log, stop, manager, name, latest.Id); err != nil {
+			// an operation started elsewhere doesn't fail this push
+			if _, failed := err.(*stackSetError); !failed || resumed {
+				return err
+			}
+		}
 	}
 
-	return hash[:6]
-}
+	if resumed && exists {
+		log.Infoln("resuming stack set", name)
+	} else if !exists {
+		log.Infoln("stack set create", name)
+		if err := manager.CreateStackSet(name, parameters, context.PipelineTemplate); err != nil {
+			return err
+		}
+	} else {
+		log.Infoln("stack set update", name)
+		id, err := manager.UpdateStackSet(name, parameters, context.PipelineTemplate, config)
+		if err != nil {
+			return err
+		}
 
-func statusUrl(logGroup, logStream, shortHash string) string {
-	base := fmt.Sprintf("https://%s.console.aws.amazon.com", os.Getenv("AWS_REGION"))
-	path := fmt.Sprintf("/cloudwatch/home?region=%s#logEventViewer:group=%s;stream=%s;filter=%s",
-		os.Getenv("AWS_REGION"),
-		logGroup,
-		logStream,
-		shortHash,
-	)
+		if err := WatchStackSet(log, stop, manager, name, id); err != nil {
+			return err
+		}
+	}
 
-	return base + path
-}
+	// instances for the accounts and regions added to the config
+	instances, err := manager.StackInstances(name)
+	if err != nil {
+		return err
+	}
 
-func statusComplete(status string) bool {
-	return types.RegexCompleted.MatchString(status)
-}
+	for _, group := range groupInstances(missingInstances(config, instances)) {
+		log.Infoln("stack instances create", group.accounts, group.regions)
+		id, err := manager.CreateStackInstances(name, group.accounts, group.regions, config)
+		if err != nil {
+			return err
+		}
 
-func statusRollback(status string) bool {
-	return types.RegexRollback.MatchString(status)
-}
+		if err := WatchStackSet(log, stop, manager, name, id); err != nil {
+			return err
+		}
+	}
 
-func statusFailed(status string) bool {
-	return types.RegexFailed.MatchString(status)
+	return nil
 }
 
-func parseRef(ref string) string {
-	components := strings.Split(ref, "/")
-	return components[len(components)-1]
-}
+// Rerun restarts the pipeline behind a check run when a re-run is requested from GitHub.
+// Pipeline check runs carry the pipeline's id, with its account and region, as their external id.
+// Prep check runs carry the delivery id of their push, which is processed again by the builder.
+func Rerun(log *log.Entry, event types.GitHubCheckRunEvent, managers func(account, region string) (types.StackManager, error), deliveries types.DeliveryStore, invoker types.LambdaManager) error {
+	rerun := event.Action == types.CheckActionRerequested ||
+		(event.Action == types.CheckActionRequested && event.RequestedAction.Identifier == types.CheckActionRerun)
 
-func parseParameters(parameters []byte) (types.ParameterManifest, error) {
-	var parsed types.ParameterManifest
-	if err := json.Unmarshal(parameters, &parsed); err != nil {
-		return parsed, err
+	if !rerun {
+		log.Warnln("received check_run event:", event.Action, "- no action")
+		return nil
 	}
 
-	return parsed, nil
-}
-
-func prepStatus(state, shortHash string) types.GitHubStatus {
-	return types.GitHubStatus{
-		State:     state,
-		Context:   types.GitContextPrep,
-		TargetUrl: statusUrl(lambdacontext.LogGroupName, lambdacontext.LogStreamName, shortHash),
+	if event.CheckRun.ExternalId == "" {
+		log.Warnln("check run has no pipeline or push - no action")
+		return nil
 	}
-}
 
-func requiredParameters(event types.GitHubEvent, repoToken, artifactStore string) []types.Parameter {
-	stage := "development"
-	branch := parseRef(event.Ref)
+	if strings.HasPrefix(event.CheckRun.Name, types.GitContextPrep) {
+		return replay(log, event, deliveries, invoker)
+	}
 
-	if refType(event.Ref) == types.GitRefMaster {
-		stage = "staging"
+	// only the repository's own pipelines may be started from its check runs
+	account, region, pipeline := target.ParsePipelineId(event.CheckRun.ExternalId)
+	if !strings.HasPrefix(pipeline, event.Repository.Name+"-") {
+		return fmt.Errorf("pipeline %s does not belong to %s", pipeline, event.Repository.Name)
 	}
 
-	if refType(event.Ref) == types.GitRefTag {
-		stage = "production"
-		branch = "master"
+	manager, err := managers(account, region)
+	if err != nil {
+		return err
 	}
 
-	return []types.Parameter{
+	log.Infoln("re-run requested by", event.Sender.Login, "for", event.CheckRun.ExternalId)
+	return manager.StartBuild(pipeline)
+}
+
+// Watch monitors the state of stack operation, returning an error if there
+// was an error in that operation. This function will continue to monitor the stack in
+// a loop until it receives a signal to stop from the given channel.
+func Watch(log *log.Entry, stop <-chan struct{}, manager types.StackManager, name string) error {
+	for polls := 0; ; polls++ {
+		select {
+		case <-stop:
+			log.Infoln("stack monitor received stop signal")
+			return ErrStopped
+		default:
+			exists, status, err := manager.Status(name)
+			if err != nil {
+				return err
+			}
+
+			if !exists {
+				return errors.New("stack not found")
+			}
+
+			log.Infoln("stack status", status)
+
+			// continue waiting until the operation ends
+			if !status.IsTerminal() {
+				time.Sleep(stack.Backoff(polls))
+				continue
+			}
+
+			// fail if the operation rolled back or failed
+			if !status.IsSuccess() {
+				return errors.New("stack rollback or failure")
+			}
+
+			return nil
+		}
+	}
+}
+
+// WatchStackSet monitors a stack set operation, returning a *stackSetError with the result
+// of each instance if the operation fails. Like Watch, it continues to monitor the operation
+// until it receives a signal to stop from the given channel.
+func WatchStackSet(log *log.Entry, stop <-chan struct{}, manager types.StackManager, name, id string) error {
+	for polls := 0; ; polls++ {
+		select {
+		case <-stop:
+			log.Infoln("stack set monitor received stop signal")
+			return ErrStopped
+		default:
+			operation, err := manager.StackSetOperation(name, id)
+			if err != nil {
+				return err
+			}
+
+			log.Infoln("stack set operation", operation.Action, "status", operation.Status)
+
+			if !operation.Done() {
+				time.Sleep(stack.Backoff(polls))
+				continue
+			}
+
+			if operation.Status != types.StackSetOperationSucceeded {
+				return &stackSetError{name: name, operation: operation}
+			}
+
+			return nil
+		}
+	}
+}
+
+//
+// Helpers
+//
+
+// stackSetError is a failed stack set operation, with the result of each of its instances.
+type stackSetError struct {
+	name      string
+	operation types.StackSetOperation
+}
+
+func (e *stackSetError) Error() string {
+	failed := e.operation.Failed()
+	message := fmt.Sprintf("stack set %s %s %s, %d of %d instances failed",
+		e.name, strings.ToLower(e.operation.Action), strings.ToLower(e.operation.Status),
+		len(failed), len(e.operation.Results))
+
+	for _, instance := range failed {
+		message += fmt.Sprintf(", %s/%s: %s", instance.Account, instance.Region, instance.Reason)
+	}
+
+	return message
+}
+
+// instanceGroup is a set of stack instances, one in each of the accounts and regions,
+// which an operation can act on at once.
+type instanceGroup struct {
+	accounts []string
+	regions  []string
+}
+
+// missingInstances returns the accounts and regions in a stack set config without an instance.
+func missingInstances(config types.StackSetConfig, instances []types.StackInstance) []types.StackInstance {
+	existing := make(map[string]bool)
+	for _, instance := range instances {
+		existing[instance.Account+"/"+instance.Region] = true
+	}
+
+	missing := make([]types.StackInstance, 0)
+	for _, region := range config.Regions {
+		for _, account := range config.Accounts {
+			if !existing[account+"/"+region] {
+				missing = append(missing, types.StackInstance{Account: account, Region: region})
+			}
+		}
+	}
+
+	return missing
+}
+
+// groupInstances groups instances by region, and merges the regions with the same accounts,
+// so that each group covers exactly the given instances. Regions keep their order.
+func groupInstances(instances []types.StackInstance) []instanceGroup {
+	regions := make([]string, 0)
+	accounts := make(map[string][]string)
+	for _, instance := range instances {
+		if _, ok := accounts[instance.Region]; !ok {
+			regions = append(regions, instance.Region)
+		}
+
+		accounts[instance.Region] = append(accounts[instance.Region], instance.Account)
+	}
+
+	groups := make([]instanceGroup, 0)
+	index := make(map[string]int)
+	for _, region := range regions {
+		sort.Strings(accounts[region])
+		key := strings.Join(accounts[region], ",")
+
+		if i, ok := index[key]; ok {
+			groups[i].regions = append(groups[i].regions, region)
+			continue
+		}
+
+		index[key] = len(groups)
+		groups = append(groups, instanceGroup{accounts: accounts[region], regions: []string{region}})
+	}
+
+	return groups
+}
+
+// deleteStackSet deletes every instance of a stack set, along with their stacks, and then
+// the stack set itself.
+func deleteStackSet(log *log.Entry, stop <-chan struct{}, manager types.StackManager, name string, config types.StackSetConfig) error {
+	instances, err := manager.StackInstances(name)
+	if err != nil {
+		return err
+	}
+
+	for _, group := range groupInstances(instances) {
+		log.Infoln("stack instances delete", group.accounts, group.regions)
+		id, err := manager.DeleteStackInstances(name, group.accounts, group.regions, config)
+		if err != nil {
+			return err
+		}
+
+		if err := WatchStackSet(log, stop, manager, name, id); err != nil {
+			return err
+		}
+	}
+
+	return manager.DeleteStackSet(name)
+}
+
+// snapshot is the template and parameters of a stack at a point in time.
+type snapshot struct {
+	template   []byte
+	parameters []types.Parameter
+}
+
+func takeSnapshot(manager types.StackManager, stack string) (*snapshot, error) {
+	template, err := manager.Template(stack)
+	if err != nil {
+		return nil, err
+	}
+
+	parameters, err := manager.Parameters(stack)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{template: template, parameters: parameters}, nil
+}
+
+// suspend hands the services still waiting on their stacks over to the watcher, which resumes
+// them once their stack events arrive. Without stack events, or if the jobs can't be saved, they're
+// resumed by a new invocation, which also processes the events remaining in this one.
+func suspend(log *log.Entry, store types.JobStore, manager types.LambdaManager, jobs []types.StackJob, remaining events.DynamoDBEvent) error {
+	saved := store != nil
+	for _, j := range jobs {
+		if !saved {
+			break
+		}
+
+		if err := store.Save(j); err != nil {
+			log.Warnln("could not save job, polling instead:", err.Error())
+			saved = false
+		}
+	}
+
+	if len(jobs) == 0 {
+		log.Infoln("all services finished while suspending")
+	} else if saved {
+		log.Infoln("waiting on stack events for", len(jobs), "services")
+	} else {
+		resume, err := job.ResumeEvent(jobs)
+		if err != nil {
+			return err
+		}
+
+		remaining.Records = append(resume.Records, remaining.Records...)
+	}
+
+	if len(remaining.Records) == 0 {
+		return nil
+	}
+
+	log.Infoln("restarting function!")
+	return manager.Invoke(lambdacontext.FunctionName, remaining)
+}
+
+// replay invokes the builder again with the push behind a prep check run, which must be the
+// check run's own commit of the same repository.
+func replay(log *log.Entry, event types.GitHubCheckRunEvent, deliveries types.DeliveryStore, invoker types.LambdaManager) error {
+	delivery, err := deliveries.Get(event.CheckRun.ExternalId)
+	if err != nil {
+		return err
+	}
+
+	if delivery == nil {
+		log.Warnln("push", event.CheckRun.ExternalId, "has expired - no action")
+		return nil
+	}
+
+	var push types.GitHubEvent
+	if err := json.Unmarshal([]byte(delivery.Payload), &push); err != nil {
+		return err
+	}
+
+	if delivery.Type != types.EventTypePush || push.Repository.Name != event.Repository.Name || push.After != event.CheckRun.HeadSha {
+		return fmt.Errorf("delivery %s is not a push of %s", delivery.Id, shortHash(event.CheckRun.HeadSha))
+	}
+
+	log.Infoln("re-run requested by", event.Sender.Login, "for push", delivery.Id)
+	return invoker.Invoke(lambdacontext.FunctionName, job.ReplayEvent(*delivery))
+}
+
+// resumedServices returns the services with a resumed job.
+func resumedServices(services []types.ServiceConfig, jobs []types.StackJob) []types.ServiceConfig {
+	resumed := make([]types.ServiceConfig, 0, len(jobs))
+	for _, service := range services {
+		if resumedDeployment(service, jobs) >= 0 {
+			resumed = append(resumed, service)
+		}
+	}
+
+	return resumed
+}
+
+// resumedDeployment returns the GitHub deployment of a service's resumed job, zero
+// if it had none, or -1 if the service wasn't resumed.
+func resumedDeployment(service types.ServiceConfig, jobs []types.StackJob) int64 {
+	for _, j := range jobs {
+		if j.Service == service.Name {
+			return j.Deployment
+		}
+	}
+
+	return -1
+}
+
+// lastDeployment returns the stack's most recently recorded deployment as a snapshot, or nil
+// if none was recorded. Its redacted parameters are unmasked like those of a stack's.
+func lastDeployment(store types.DeploymentStore, stack string) (*snapshot, error) {
+	deployments, err := store.List(stack)
+	if err != nil || len(deployments) == 0 {
+		return nil, err
+	}
+
+	deployment, err := store.Get(stack, deployments[0].Id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &snapshot{template: deployment.Template, parameters: deployment.Parameters}, nil
+}
+
+// recordDeployment saves the stack's current template and parameters as deployed from the event's commit.
+func recordDeployment(store types.DeploymentStore, manager types.StackManager, event types.GitHubEvent, stack string) error {
+	current, err := takeSnapshot(manager, stack)
+	if err != nil {
+		return err
+	}
+
+	return store.Save(types.Deployment{
+		Stack:      stack,
+		Repo:       event.Repository.FullName,
+		Ref:        parseRef(event.Ref),
+		Commit:     tagCommit(event),
+		Deployed:   time.Now().UTC(),
+		Parameters: history.Redact(current.parameters),
+		Template:   current.template,
+	})
+}
+
+// recoverStack brings a stack which can't be updated back to a state which can, returning its
+// new state. Outside of production, stacks which failed to create are deleted, to be created
+// again. Updates which failed to roll back continue rolling back, skipping the resources which
+// failed. Anything else is left to be fixed by hand.
+func recoverStack(log *log.Entry, stop <-chan struct{}, manager types.StackManager, stack string, status types.StackStatus, stage string) (bool, types.StackStatus, error) {
+	switch status {
+	case types.StackStatusRollbackComplete, types.StackStatusRollbackFailed:
+		if stage == types.StageProduction {
+			return true, status, intervention(stack, status, "delete the stack to create it again")
+		}
+
+		log.Warnln("stack failed to create, deleting", stack)
+		if err := manager.Delete(stack); err != nil {
+			return true, status, err
+		}
+
+		return awaitDelete(log, stop, manager, stack)
+	case types.StackStatusDeleteInProgress:
+		// a previous invocation may have been deleting the stack
+		return awaitDelete(log, stop, manager, stack)
+	case types.StackStatusUpdateRollbackFailed:
+		skip, err := manager.FailedResources(stack)
+		if err != nil {
+			return true, status, err
+		}
+
+		log.Warnln("continuing stack rollback, skipping", skip)
+		if err := manager.ContinueRollback(stack, skip); err != nil {
+			return true, status, intervention(stack, status, err.Error())
+		}
+
+		if _, status, err = await(log, stop, manager, stack); err != nil {
+			return true, status, err
+		}
+
+		if status != types.StackStatusUpdateRollbackComplete {
+			return true, status, intervention(stack, status, "rollback did not complete")
+		}
+
+		return true, status, nil
+	case types.StackStatusDeleteFailed:
+		return true, status, intervention(stack, status, "delete or retain the resources which failed to delete")
+	}
+
+	return true, status, nil
+}
+
+// await waits for a stack operation to end, returning the stack's state.
+func await(log *log.Entry, stop <-chan struct{}, manager types.StackManager, name string) (bool, types.StackStatus, error) {
+	for polls := 0; ; polls++ {
+		select {
+		case <-stop:
+			return false, "", ErrStopped
+		default:
+			exists, status, err := manager.Status(name)
+			if err != nil || !exists || status.IsTerminal() {
+				return exists, status, err
+			}
+
+			log.Infoln("stack status", status)
+			time.Sleep(stack.Backoff(polls))
+		}
+	}
+}
+
+func awaitDelete(log *log.Entry, stop <-chan struct{}, manager types.StackManager, stack string) (bool, types.StackStatus, error) {
+	exists, status, err := await(log, stop, manager, stack)
+	if err != nil {
+		return exists, status, err
+	}
+
+	if exists {
+		return true, status, intervention(stack, status, "stack could not be deleted")
+	}
+
+	log.Infoln("stack deleted", stack)
+	return false, "", nil
+}
+
+func intervention(stack string, status types.StackStatus, reason string) error {
+	return fmt.Errorf("manual intervention required, %s is %s: %s", stack, status, reason)
+}
+
+// checkDrift refuses to update a stack whose last detected drift wasn't acknowledged.
+func checkDrift(store types.DriftStore, stack string) error {
+	drift, err := store.Get(stack)
+	if err != nil {
+		return err
+	}
+
+	if drift != nil && drift.Blocking() {
+		return fmt.Errorf("stack drifted from its template (%d resources), acknowledge the drift to deploy", len(drift.Resources))
+	}
+
+	return nil
+}
+
+// checkHealth waits for an updated stack to pass its health checks.
+func checkHealth(log *log.Entry, stop <-chan struct{}, config types.HealthCheckConfig, manager types.StackManager, checker types.HealthChecker, stack string) error {
+	timeout, err := time.ParseDuration(config.Timeout)
+	if err != nil {
+		return err
+	}
+
+	outputs, err := manager.Outputs(stack)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(timeout)
+	for {
+		waiting, err := health.Evaluate(checker, config, outputs)
+		if err != nil {
+			return err
+		}
+
+		if waiting == "" {
+			log.Infoln("stack healthy")
+			return nil
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("not healthy after %s: %s", config.Timeout, waiting)
+		}
+
+		log.Infoln("waiting for stack health:", waiting)
+
+		select {
+		case <-stop:
+			return ErrStopped
+		case <-time.After(HealthCheckInterval):
+		}
+	}
+}
+
+// rollback re-deploys the stack's previous template and parameters after a failed health check.
+// The health check failure is returned regardless, describing the outcome of the rollback.
+func rollback(log *log.Entry, stop <-chan struct{}, config types.HealthCheckConfig, manager types.StackManager, stack string, previous *snapshot, current []types.Parameter, failure error) error {
+	message := "health check failed: " + failure.Error()
+
+	if config.Rollback != nil && !*(config.Rollback) {
+		return errors.New(message)
+	}
+
+	if previous == nil {
+		return errors.New(message + "; no previous deployment to roll back to")
+	}
+
+	log.Warnln(message, "- rolling back")
+
+	parameters := unmaskParameters(previous.parameters, current)
+	if err := manager.Update(stack, parameters, previous.template); err != nil {
+		return fmt.Errorf("%s; rollback failed: %s", message, err.Error())
+	}
+
+	if err := Watch(log, stop, manager, stack); err != nil {
+		return fmt.Errorf("%s; rollback failed: %s", message, err.Error())
+	}
+
+	return errors.New(message + "; rolled back to the previous deployment")
+}
+
+// unmaskParameters replaces the masked values of NoEcho parameters, as described by
+// CloudFormation, with their current values.
+func unmaskParameters(parameters, current []types.Parameter) []types.Parameter {
+	values := make(map[string]string)
+	for _, p := range current {
+		values[p.ParameterKey] = p.ParameterValue
+	}
+
+	unmasked := make([]types.Parameter, 0, len(parameters))
+	for _, p := range parameters {
+		if value, ok := values[p.ParameterKey]; ok && p.ParameterValue == types.ParameterMasked {
+			p.ParameterValue = value
+		}
+
+		unmasked = append(unmasked, p)
+	}
+
+	return unmasked
+}
+
+func stackName(event types.GitHubEvent, suffix string) string {
+	repo := event.Repository.Name
+	name := fmt.Sprintf("%s-%s", repo, parseRef(event.Ref))
+
+	if eventRefType(event) == types.GitRefDefault {
+		name = fmt.Sprintf("%s-staging", repo)
+	}
+
+	if eventRefType(event) == types.GitRefPreRelease {
+		name = fmt.Sprintf("%s-preproduction", repo)
+	}
+
+	if eventRefType(event) == types.GitRefTag {
+		name = fmt.Sprintf("%s-production", repo)
+	}
+
+	if suffix != "" {
+		name = fmt.Sprintf("%s-%s", name, suffix)
+	}
+
+	return name
+}
+
+func shortHash(hash string) string {
+	if len(hash) < 6 {
+		return hash
+	}
+
+	return hash[:6]
+}
+
+func statusUrl(logGroup, logStream, shortHash string) string {
+	base := fmt.Sprintf("https://%s.console.aws.amazon.com", os.Getenv("AWS_REGION"))
+	path := fmt.Sprintf("/cloudwatch/home?region=%s#logEventViewer:group=%s;stream=%s;filter=%s",
+		os.Getenv("AWS_REGION"),
+		logGroup,
+		logStream,
+		shortHash,
+	)
+
+	return base + path
+}
+
+func parseRef(ref string) string {
+	components := strings.Split(ref, "/")
+	return components[len(components)-1]
+}
+
+func parseParameters(parameters []byte) (types.ParameterManifest, error) {
+	var parsed types.ParameterManifest
+	if err := json.Unmarshal(parameters, &parsed); err != nil {
+		return parsed, err
+	}
+
+	return parsed, nil
+}
+
+func prepStatus(service, state, shortHash string) types.GitHubStatus {
+	context := types.GitContextPrep
+	if service != "" {
+		context = fmt.Sprintf("%s/%s", types.GitContextPrep, service)
+	}
+
+	return types.GitHubStatus{
+		State:     state,
+		Context:   context,
+		TargetUrl: statusUrl(lambdacontext.LogGroupName, lambdacontext.LogStreamName, shortHash),
+	}
+}
+
+// deploy creates a deployment of the pushed commit to the service's environment and marks it in
+// progress. An existing deployment of the commit to the same stack is reused, i.e. when the
+// builder has been restarted.
+func deploy(repo types.Repository, event types.GitHubEvent, service types.ServiceConfig, shortHash string) (int64, error) {
+	sha := event.After
+	if isTag(event) {
+		sha = tagCommit(event)
+	}
+
+	stack := stackName(event, service.StackSuffix)
+	env := environment(event, service)
+
+	existing, err := repo.Deployments(sha, env)
+	if err != nil {
+		return 0, err
+	}
+
+	for _, deployment := range existing {
+		if deployment.Payload.Stack == stack {
+			return deployment.Id, nil
+		}
+	}
+
+	id, err := repo.Deploy(types.GitHubDeployment{
+		Ref:                   sha,
+		Task:                  "deploy",
+		Environment:           env,
+		Description:           fmt.Sprintf("Deploy %s", stack),
+		ProductionEnvironment: refStage(event) == types.StageProduction,
+		TransientEnvironment:  refStage(event) == types.StageDevelopment,
+		Payload: types.DeploymentPayload{
+			Stack:     stack,
+			UrlOutput: service.EnvironmentUrlOutput,
+		},
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	return id, repo.DeploymentStatus(id, types.GitHubDeploymentStatus{
+		State:  types.DeploymentStateInProgress,
+		LogUrl: statusUrl(lambdacontext.LogGroupName, lambdacontext.LogStreamName, shortHash),
+	})
+}
+
+// environment names the deployment environment of a service, the stage for staging and
+// production deploys, otherwise the branch name.
+func environment(event types.GitHubEvent, service types.ServiceConfig) string {
+	env := refStage(event)
+	if env == types.StageDevelopment {
+		env = parseRef(event.Ref)
+	}
+
+	if service.Name != "" {
+		env = fmt.Sprintf("%s/%s", env, service.Name)
+	}
+
+	return env
+}
+
+// report posts a commit status, or a check run with the given output (if any) when checks
+// are enabled. Failed prep check runs offer a re-run action, handled by Rerun, which finds
+// the push by the delivery id the run carries.
+func report(r types.Repository, sha string, status types.GitHubStatus, deliveryId string, output *types.GitHubCheckOutput) error {
+	if !repo.ChecksEnabled() {
+		if status.State == types.GitStateSkipped {
+			status.State = types.GitStateSuccess
+		}
+
+		return r.Status(sha, status)
+	}
+
+	run := status.CheckRun()
+	run.ExternalId = deliveryId
+
+	if output != nil {
+		run.Output = output
+	}
+
+	if deliveryId != "" && (status.State == types.GitStateFailure || status.State == types.GitStateError) {
+		run.Actions = []types.GitHubCheckAction{
+			types.GitHubCheckAction{
+				Label:       "Re-run",
+				Description: "Prepare the stacks of the push again",
+				Identifier:  types.CheckActionRerun,
+			},
+		}
+	}
+
+	return r.Check(sha, run)
+}
+
+// notifyPrep sends a notification for the result of preparing a service's stack.
+func notifyPrep(log *log.Entry, notifier types.Notifier, event types.GitHubEvent, stack string, status types.GitHubStatus, err error) {
+	notification := types.Notification{
+		Event:       types.NotifyEventPrepSucceeded,
+		Level:       types.NotifyLevelSuccess,
+		Repo:        event.Repository.FullName,
+		Environment: refStage(event),
+		Title:       fmt.Sprintf("Stack %s is ready", stack),
+		Url:         status.TargetUrl,
+		Fields: map[string]string{
+			"ref":    parseRef(event.Ref),
+			"commit": shortHash(event.After),
+			"pusher": event.Pusher.Name,
+		},
+	}
+
+	if err != nil {
+		notification.Event = types.NotifyEventPrepFailed
+		notification.Level = types.NotifyLevelFailure
+		notification.Title = fmt.Sprintf("Preparing stack %s failed", stack)
+		notification.Text = err.Error()
+	}
+
+	if err := notifier.Notify(notification); err != nil {
+		log.Warnln("could not send notification:", err.Error())
+	}
+}
+
+// successOutput summarizes a successful stack operation for a check run
+func successOutput(event types.GitHubEvent, stack string) *types.GitHubCheckOutput {
+	summary := fmt.Sprintf("Stack `%s` is up to date for the `%s` stage.", stack, refStage(event))
+	if version, err := tagVersion(event.Ref); err == nil {
+		summary += fmt.Sprintf(" Version `%s`.", version)
+	}
+
+	return &types.GitHubCheckOutput{
+		Title:   "Stack ready",
+		Summary: summary,
+	}
+}
+
+// stackSetOutput summarizes the instances of a stack set, for a status description and
+// a check run.
+func stackSetOutput(event types.GitHubEvent, manager types.StackManager, name string) (string, *types.GitHubCheckOutput) {
+	instances, err := manager.StackInstances(name)
+	if err != nil {
+		return "", successOutput(event, name)
+	}
+
+	current := 0
+	for _, instance := range instances {
+		if instance.Status == types.StackInstanceCurrent {
+			current++
+		}
+	}
+
+	description := fmt.Sprintf("%d of %d stack instances up to date", current, len(instances))
+	return description, &types.GitHubCheckOutput{
+		Title:   "Stack set ready",
+		Summary: fmt.Sprintf("Stack set `%s` is deployed for the `%s` stage, %s.", name, refStage(event), description),
+		Text:    instanceTable(instances),
+	}
+}
+
+// instanceTable lists stack instances, or their results, as a markdown table.
+func instanceTable(instances []types.StackInstance) string {
+	if len(instances) == 0 {
+		return ""
+	}
+
+	var text bytes.Buffer
+	text.WriteString("| Account | Region | Status | Reason |\n|---|---|---|---|\n")
+	for _, instance := range instances {
+		fmt.Fprintf(&text, "| %s | %s | %s | %s |\n", instance.Account, instance.Region, instance.Status,
+			strings.Replace(instance.Reason, "|", "\\|", -1))
+	}
+
+	return text.String()
+}
+
+// failureOutput reports a failed stack operation for a check run, listing the resources
+// that failed during the stack's latest operation, annotated on the pipeline template.
+func failureOutput(err error, service types.ServiceConfig, stack string, manager types.StackManager) *types.GitHubCheckOutput {
+	output := &types.GitHubCheckOutput{
+		Title:   types.StatusDescription(err.Error()),
+		Summary: fmt.Sprintf("Preparing stack `%s` failed: %s", stack, err.Error()),
+	}
+
+	// stack sets report the result of each instance, rather than stack events
+	if setErr, ok := err.(*stackSetError); ok {
+		output.Summary = fmt.Sprintf("Stack set `%s` %s %s.", stack,
+			strings.ToLower(setErr.operation.Action), strings.ToLower(setErr.operation.Status))
+		output.Text = instanceTable(setErr.operation.Results)
+		return output
+	}
+
+	if service.StackSet != nil {
+		return output
+	}
+
+	events, eventsErr := manager.Events(stack)
+	if eventsErr != nil {
+		return output
+	}
+
+	var text bytes.Buffer
+	for _, event := range events {
+		// stop at the start of the latest stack operation
+		if event.LogicalResourceId == stack && operationStart(types.StackStatus(event.ResourceStatus)) {
+			break
+		}
+
+		// resource statuses, like CREATE_FAILED or UPDATE_FAILED, aren't all stack statuses
+		if !strings.HasSuffix(event.ResourceStatus, "_FAILED") || event.ResourceStatusReason == "" {
+			continue
+		}
+
+		if text.Len() == 0 {
+			text.WriteString("| Resource | Type | Status | Reason |\n|---|---|---|---|\n")
+		}
+
+		fmt.Fprintf(&text, "| %s | %s | %s | %s |\n",
+			event.LogicalResourceId, event.ResourceType, event.ResourceStatus,
+			strings.Replace(event.ResourceStatusReason, "|", "\\|", -1))
+
+		output.Annotations = append(output.Annotations, types.GitHubCheckAnnotation{
+			Path:            service.Pipeline,
+			StartLine:       1,
+			EndLine:         1,
+			AnnotationLevel: types.CheckAnnotationFailure,
+			Title:           event.LogicalResourceId,
+			Message:         event.ResourceStatusReason,
+		})
+	}
+
+	output.Text = text.String()
+	return output
+}
+
+func operationStart(status types.StackStatus) bool {
+	return status == types.StackStatusCreateInProgress || status == types.StackStatusUpdateInProgress || status == types.StackStatusDeleteInProgress
+}
+
+// skipStatus reports a build skipped by a build filter, as a neutral check run. The status
+// API has no neutral state, so commit statuses report it as successful, with the reason
+// in the description.
+func skipStatus(reason, shortHash string) types.GitHubStatus {
+	if reason == "" {
+		reason = "matched build filter"
+	}
+
+	status := prepStatus("", types.GitStateSkipped, shortHash)
+	status.Description = types.StatusDescription("build skipped: " + reason)
+
+	return status
+}
+
+// repoConfig reads the repository's service definitions. Repositories without a config
+// file define a single, unnamed service at the repository root.
+func repoConfig(event types.GitHubEvent, repo types.Repository) (types.RepoConfig, error) {
+	// deleted refs no longer exist, read the config as of the last commit
+	ref := event.Ref
+	if event.Deleted {
+		ref = event.Before
+	}
+
+	spec, err := repo.Get(ref, ConfigPath)
+	if err != nil {
+		if _, ok := err.(types.RepoNotFoundError); ok {
+			return types.RepoConfig{
+				Services: []types.ServiceConfig{
+					types.ServiceConfig{
+						Pipeline:             PipelinePath,
+						Parameters:           ParametersPath,
+						EnvironmentUrlOutput: types.EnvironmentUrlOutput,
+					},
+				},
+			}, nil
+		}
+
+		return types.RepoConfig{}, err
+	}
+
+	var config types.RepoConfig
+	if err := json.Unmarshal(spec, &config); err != nil {
+		return config, fmt.Errorf("%s: %s", ConfigPath, err.Error())
+	}
+
+	if err := config.Validate(); err != nil {
+		return config, fmt.Errorf("%s: %s", ConfigPath, err.Error())
+	}
+
+	return config, nil
+}
+
+// affectedServices returns the services whose path filters match the files changed by the push.
+// Every service is affected when the changes are unknown (nil), or the build is forced.
+func affectedServices(config types.RepoConfig, changes []string, force bool) []types.ServiceConfig {
+	services := make([]types.ServiceConfig, 0)
+	for _, service := range config.Services {
+		if !force && changes != nil && len(service.Paths) > 0 && !paths.MatchAny(service.Paths, changes) {
+			continue
+		}
+
+		services = append(services, service)
+	}
+
+	return services
+}
+
+// changedFiles lists every file added, modified or removed by the push. Returns nil if the
+// changes can't be determined from the payload, i.e. for new or deleted refs, tags,
+// and pushes exceeding the commit list limit.
+func changedFiles(event types.GitHubEvent) []string {
+	if event.Created || event.Deleted || isTag(event) {
+		return nil
+	}
+
+	if len(event.Commits) == 0 || len(event.Commits) >= MaxPushCommits {
+		return nil
+	}
+
+	files := make([]string, 0)
+	for _, commit := range event.Commits {
+		files = append(files, commit.Added...)
+		files = append(files, commit.Modified...)
+		files = append(files, commit.Removed...)
+	}
+
+	return files
+}
+
+func requiredParameters(event types.GitHubEvent, repoToken, artifactStore string) []types.Parameter {
+	stage := refStage(event)
+	branch := parseRef(event.Ref)
+
+	// GitHub sources can only build branches, tags build the default branch once
+	// checkHead has made sure its head is still the tagged commit
+	if isTag(event) {
+		branch = event.Repository.DefaultBranch
+	}
+
+	// tags expose their parsed version, empty for branches
+	version := ""
+	if parsed, err := tagVersion(event.Ref); err == nil {
+		version = parsed.String()
+	}
+
+	return []types.Parameter{
 		types.Parameter{ParameterKey: "ArtifactStore", ParameterValue: artifactStore},
 		types.Parameter{ParameterKey: "RepoOwner", ParameterValue: event.Repository.Owner.Name},
 		types.Parameter{ParameterKey: "RepoName", ParameterValue: event.Repository.Name},
 		types.Parameter{ParameterKey: "RepoBranch", ParameterValue: branch},
-		types.Parameter{ParameterKey: "RepoToken", ParameterValue: repoToken},
-		types.Parameter{ParameterKey: "Stage", ParameterValue: stage},
+		types.Parameter{ParameterKey: types.ParameterRepoToken, ParameterValue: repoToken},
+		types.Parameter{ParameterKey: types.ParameterStage, ParameterValue: stage},
+		types.Parameter{ParameterKey: types.ParameterVersion, ParameterValue: version},
 	}
 }
 
-func refType(ref string) string {
-	parsed := parseRef(ref)
+// stackSetParameters are the parameters set on every stack set, besides those of its manifest.
+func stackSetParameters(event types.GitHubEvent) []types.Parameter {
+	version := ""
+	if parsed, err := tagVersion(event.Ref); err == nil {
+		version = parsed.String()
+	}
+
+	return []types.Parameter{
+		types.Parameter{ParameterKey: types.ParameterStage, ParameterValue: refStage(event)},
+		types.Parameter{ParameterKey: types.ParameterVersion, ParameterValue: version},
+	}
+}
+
+// refType routes a ref by kind. Only tags named by a valid semantic version are
+// releases; branches, and any other tags, are deployed like feature branches.
+// declaredParameters drops the optional parameters the template doesn't declare, as
+// CloudFormation rejects undeclared parameters. Templates written before a parameter
+// was introduced keep working without it.
+func declaredParameters(manager types.StackManager, template []byte, parameters []types.Parameter, optional ...string) ([]types.Parameter, error) {
+	names, err := manager.TemplateParameters(template)
+	if err != nil {
+		return nil, err
+	}
+
+	skip := make(map[string]bool)
+	for _, key := range optional {
+		skip[key] = true
+	}
+
+	for _, name := range names {
+		skip[name] = false
+	}
+
+	filtered := make([]types.Parameter, 0, len(parameters))
+	for _, p := range parameters {
+		if skip[p.ParameterKey] {
+			continue
+		}
+
+		filtered = append(filtered, p)
+	}
+
+	return filtered, nil
+}
+
+func refType(ref, defaultBranch string) string {
+	if ref == "refs/heads/"+defaultBranch {
+		return types.GitRefDefault
+	}
+
+	if version, err := tagVersion(ref); err == nil {
+		if version.IsPreRelease() {
+			return types.GitRefPreRelease
+		}
 
-	if parsed == types.GitRefMaster {
-		return types.GitRefMaster
-	} else if types.RegexTagRef.MatchString(parsed) {
 		return types.GitRefTag
 	}
 
 	return types.GitRefBranch
 }
 
+// tagCommit returns the commit referenced by a tag push. For annotated tags
+// 'after' is the tag object, so prefer the head commit.
+func tagCommit(event types.GitHubEvent) string {
+	if event.HeadCommit != nil && event.HeadCommit.Id != "" {
+		return event.HeadCommit.Id
+	}
+
+	return event.After
+}
+
+// checkHead returns an error if the head of the default branch is no longer the tagged
+// commit, in which case the pipeline would build something other than the tag.
+func checkHead(repo types.Repository, event types.GitHubEvent) error {
+	head, err := repo.Head(event.Repository.DefaultBranch)
+	if err != nil {
+		return err
+	}
+
+	if commit := tagCommit(event); head != commit {
+		return fmt.Errorf("%s has moved on from the tagged commit %s to %s",
+			event.Repository.DefaultBranch, shortHash(commit), shortHash(head))
+	}
+
+	return nil
+}
+
+func eventRefType(event types.GitHubEvent) string {
+	return refType(event.Ref, event.Repository.DefaultBranch)
+}
+
+// isTag reports whether the event is for a release or pre-release tag
+func isTag(event types.GitHubEvent) bool {
+	t := eventRefType(event)
+	return t == types.GitRefTag || t == types.GitRefPreRelease
+}
+
+// tagVersion parses the 'v' prefixed semantic version naming a tag ref, i.e. 'refs/tags/v1.2.0-rc.1'
+func tagVersion(ref string) (semver.Version, error) {
+	name := strings.TrimPrefix(ref, types.GitTagPrefix)
+	if name == ref || !strings.HasPrefix(name, "v") {
+		return semver.Version{}, fmt.Errorf("not a version tag %q", ref)
+	}
+
+	return semver.Parse(name)
+}
+
+// checkVersion returns an error if the tag's version is lower than the version
+// currently deployed to the stack. Stacks without a valid version are not checked.
+func checkVersion(log *log.Entry, event types.GitHubEvent, manager types.StackManager, stack string) error {
+	version, err := tagVersion(event.Ref)
+	if err != nil {
+		return err
+	}
+
+	parameters, err := manager.Parameters(stack)
+	if err != nil {
+		return err
+	}
+
+	for _, p := range parameters {
+		if p.ParameterKey != types.ParameterVersion || p.ParameterValue == "" {
+			continue
+		}
+
+		deployed, err := semver.Parse(p.ParameterValue)
+		if err != nil {
+			log.Warnln("stack has invalid version:", p.ParameterValue)
+			return nil
+		}
+
+		if version.Compare(deployed) < 0 {
+			return fmt.Errorf("refusing to deploy %s, %s is at %s", version, stack, deployed)
+		}
+	}
+
+	return nil
+}
+
+// refStage maps an event's ref to the pipeline stage it deploys.
+func refStage(event types.GitHubEvent) string {
+	switch eventRefType(event) {
+	case types.GitRefDefault:
+		return types.StageStaging
+	case types.GitRefPreRelease:
+		return types.StagePreProduction
+	case types.GitRefTag:
+		return types.StageProduction
+	}
+
+	return types.StageDevelopment
+}
+
 func buildContext(event types.GitHubEvent, repo types.Repository, pipelinePath, parameterPath string) (types.BuildContext, error) {
 	// pipeline template (required)
 	pipelineTemplate, err := repo.Get(event.Ref, pipelinePath)
@@ -386,18 +1858,13 @@ func buildContext(event types.GitHubEvent, repo types.Repository, pipelinePath,
 
 	parameterManifest, err := parseParameters(parameterSpec)
 	if err != nil {
-		return types.BuildContext{}, err
+		return types.BuildContext{}, fmt.Errorf("%s: %s", parameterPath, err.Error())
 	}
 
-	// Default to development parameters, set staging or production accordingly
-	parameters := parameterManifest.Development
-
-	if refType(event.Ref) == types.GitRefMaster {
-		parameters = parameterManifest.Staging
-	}
-
-	if refType(event.Ref) == types.GitRefTag {
-		parameters = parameterManifest.Production
+	// Select the parameter set for the ref's stage, failing if it isn't defined
+	parameters, err := parameterManifest.Stage(refStage(event))
+	if err != nil {
+		return types.BuildContext{}, fmt.Errorf("%s: %s", parameterPath, err.Error())
 	}
 
 	context := types.BuildContext{
@@ -0,0 +1,58 @@
+package container
+
+import (
+	"errors"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+type AWSContainerManager struct {
+	client *ecs.ECS
+}
+
+func NewAWSContainerManager(session *session.Session) *AWSContainerManager {
+	return &AWSContainerManager{
+		client: ecs.New(session),
+	}
+}
+
+// ServiceArn returns the ARN of a cluster's service, by name.
+func (m *AWSContainerManager) ServiceArn(cluster, name string) (string, error) {
+	resp, err := m.client.DescribeServices(&ecs.DescribeServicesInput{
+		Cluster:  aws.String(cluster),
+		Services: aws.StringSlice([]string{name}),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(resp.Services) == 0 {
+		return "", errors.New("service not found: " + name)
+	}
+
+	return aws.StringValue(resp.Services[0].ServiceArn), nil
+}
+
+// EssentialContainers returns the names of a task definition's essential containers,
+// whose failure stops the task. Containers are essential unless marked otherwise.
+func (m *AWSContainerManager) EssentialContainers(taskDefinition string) ([]string, error) {
+	resp, err := m.client.DescribeTaskDefinition(&ecs.DescribeTaskDefinitionInput{
+		TaskDefinition: aws.String(taskDefinition),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0)
+	for _, definition := range resp.TaskDefinition.ContainerDefinitions {
+		if definition.Essential == nil || *(definition.Essential) {
+			names = append(names, aws.StringValue(definition.Name))
+		}
+	}
+
+	return names, nil
+}
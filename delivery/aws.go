@@ -0,0 +1,59 @@
+package delivery
+
+import (
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+// AWSDeliveryStore reads the events stored by the listener in a DynamoDB table, keyed by 'id'.
+type AWSDeliveryStore struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+// record is the stored form of an event, as written by the listener.
+type record struct {
+	Id      string `dynamodbav:"id"`
+	Type    string `dynamodbav:"type"`
+	Payload string `dynamodbav:"payload"`
+}
+
+func NewAWSDeliveryStore(session *session.Session, table string) *AWSDeliveryStore {
+	return &AWSDeliveryStore{
+		client: dynamodb.New(session),
+		table:  table,
+	}
+}
+
+// Get returns the event of a delivery, or nil if it has expired.
+func (s *AWSDeliveryStore) Get(id string) (*types.Delivery, error) {
+	resp, err := s.client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id": {S: aws.String(id)},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+
+	var r record
+	if err := dynamodbattribute.UnmarshalMap(resp.Item, &r); err != nil {
+		return nil, err
+	}
+
+	return &types.Delivery{
+		Id:      r.Id,
+		Type:    r.Type,
+		Payload: r.Payload,
+	}, nil
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"os"
+
+	"github.com/ngmiller/fabrik/drift"
+	"github.com/ngmiller/fabrik/history"
+	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/stack"
+	"github.com/ngmiller/fabrik/target"
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	log "github.com/sirupsen/logrus"
+)
+
+// RollbackRequest is the body of a rollback request.
+type RollbackRequest struct {
+	Stack string `json:"stack"`
+	Id    string `json:"id"`
+}
+
+// AcknowledgeRequest is the body of a drift acknowledgement.
+type AcknowledgeRequest struct {
+	Stack string `json:"stack"`
+	By    string `json:"by"`
+}
+
+// requestError is a rollback which can't be performed, reported to the caller as is.
+type requestError struct {
+	status  int
+	message string
+}
+
+func (e requestError) Error() string {
+	return e.message
+}
+
+// Assumed role sessions of the deployment targets, kept while the function is warm
+var targetSessions *target.Sessions
+
+func init() {
+	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+// Handler lists the deployments recorded by the builder for a stack, and rolls stacks back
+// to them. i.e. GET /deployments?stack=repo-production, or POST /deployments/rollback
+// with a body of {"stack": "repo-production", "id": "1530000000"}
+// The drift detected in a stack is also reported, and acknowledged, through GET /drift?stack=
+// and POST /drift/acknowledge with a body of {"stack": "repo-production", "by": "name"}
+func Handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln("recovered from panic:", r)
+		}
+	}()
+
+	sess := session.Must(session.NewSession())
+	store := history.NewAWSDeploymentStore(sess, os.Getenv("DEPLOYMENT_TABLE"), os.Getenv("ARTIFACT_STORE"))
+	drifts := drift.NewAWSDriftStore(sess, os.Getenv("DRIFT_TABLE"))
+
+	switch request.Resource {
+	case "/drift":
+		return driftReport(drifts, request.QueryStringParameters["stack"]), nil
+	case "/drift/acknowledge":
+		return acknowledge(drifts, request.Body), nil
+	}
+
+	if request.HTTPMethod == http.MethodGet {
+		name := request.QueryStringParameters["stack"]
+		if name == "" {
+			return response(http.StatusBadRequest, map[string]string{"error": "stack is required"}), nil
+		}
+
+		deployments, err := store.List(name)
+		if err != nil {
+			log.Errorln("error listing deployments:", err.Error())
+			return response(http.StatusInternalServerError, map[string]string{"error": "could not list deployments"}), nil
+		}
+
+		return response(http.StatusOK, deployments), nil
+	}
+
+	var rollback RollbackRequest
+	if err := json.Unmarshal([]byte(request.Body), &rollback); err != nil || rollback.Stack == "" || rollback.Id == "" {
+		return response(http.StatusBadRequest, map[string]string{"error": "stack and id are required"}), nil
+	}
+
+	log := log.WithFields(log.Fields{"stack": rollback.Stack, "deployment": rollback.Id})
+
+	// stacks of deployment targets are rolled back through the target's role
+	targets, err := target.Load(secure.NewAWSSecureStore(sess))
+	if err != nil && !secure.NotFound(err) {
+		log.Errorln("error loading deployment targets:", err.Error())
+		return response(http.StatusInternalServerError, map[string]string{"error": "could not load deployment targets"}), nil
+	}
+
+	if targetSessions == nil {
+		targetSessions = target.NewSessions(sess, os.Getenv("ARTIFACT_STORE"))
+	}
+
+	managers := func(account, region string) (types.StackManager, error) {
+		stackSession, err := targetSessions.Resolve(targets, account, region)
+		if err != nil {
+			return nil, err
+		}
+
+		return stack.NewAWSStackManager(log, stackSession), nil
+	}
+
+	deployment, err := Process(log, managers, store, rollback.Stack, rollback.Id)
+	if err != nil {
+		if e, ok := err.(requestError); ok {
+			return response(e.status, map[string]string{"error": e.message}), nil
+		}
+
+		log.Errorln("error rolling back:", err.Error())
+		return response(http.StatusInternalServerError, map[string]string{"error": "could not roll back"}), nil
+	}
+
+	return response(http.StatusAccepted, deployment), nil
+}
+
+// Process starts an update of the stack to a recorded deployment's template and parameters,
+// in the account and region it was deployed to. The update isn't watched, and it's recorded
+// as a deployment once the stack is next deployed.
+func Process(log *log.Entry, managers func(account, region string) (types.StackManager, error), store types.DeploymentStore, name, id string) (types.Deployment, error) {
+	deployment, err := store.Get(name, id)
+	if err == history.ErrDeploymentNotFound {
+		return types.Deployment{}, requestError{http.StatusNotFound, "deployment not found: " + id}
+	} else if err != nil {
+		return types.Deployment{}, err
+	}
+
+	manager, err := managers(deployment.Account, deployment.Region)
+	if err != nil {
+		return types.Deployment{}, err
+	}
+
+	exists, status, err := manager.Status(name)
+	if err != nil {
+		return types.Deployment{}, err
+	}
+
+	if !exists {
+		return types.Deployment{}, requestError{http.StatusNotFound, "stack not found: " + name}
+	}
+
+	if !status.CanUpdate() {
+		return types.Deployment{}, requestError{http.StatusConflict, "stack can't be updated while " + string(status)}
+	}
+
+	log.Infoln("rolling back to", deployment.Commit, "deployed", deployment.Deployed)
+	if err := manager.Update(name, history.Restore(deployment.Parameters), deployment.Template); err != nil {
+		return types.Deployment{}, errors.New("stack update failed: " + err.Error())
+	}
+
+	return deployment, nil
+}
+
+//
+// Helpers
+//
+
+func driftReport(store types.DriftStore, name string) events.APIGatewayProxyResponse {
+	if name == "" {
+		return response(http.StatusBadRequest, map[string]string{"error": "stack is required"})
+	}
+
+	current, err := store.Get(name)
+	if err != nil {
+		log.Errorln("error getting drift:", err.Error())
+		return response(http.StatusInternalServerError, map[string]string{"error": "could not get drift"})
+	}
+
+	if current == nil {
+		return response(http.StatusNotFound, map[string]string{"error": "drift not detected for stack: " + name})
+	}
+
+	return response(http.StatusOK, current)
+}
+
+func acknowledge(store types.DriftStore, body string) events.APIGatewayProxyResponse {
+	var request AcknowledgeRequest
+	if err := json.Unmarshal([]byte(body), &request); err != nil || request.Stack == "" || request.By == "" {
+		return response(http.StatusBadRequest, map[string]string{"error": "stack and by are required"})
+	}
+
+	if err := store.Acknowledge(request.Stack, request.By); err != nil {
+		if err == drift.ErrNoDrift {
+			return response(http.StatusNotFound, map[string]string{"error": err.Error()})
+		}
+
+		log.Errorln("error acknowledging drift:", err.Error())
+		return response(http.StatusInternalServerError, map[string]string{"error": "could not acknowledge drift"})
+	}
+
+	log.WithFields(log.Fields{"stack": request.Stack}).Infoln("drift acknowledged by", request.By)
+	return response(http.StatusOK, map[string]string{"stack": request.Stack, "acknowledged": request.By})
+}
+
+func response(status int, body interface{}) events.APIGatewayProxyResponse {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(payload),
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ngmiller/fabrik/drift"
+	"github.com/ngmiller/fabrik/notify"
+	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/stack"
+	"github.com/ngmiller/fabrik/target"
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Execution timeout in seconds
+	ExecutionTimeout = 300
+)
+
+// Assumed role sessions of the deployment targets, kept while the function is warm
+var targetSessions *target.Sessions
+
+func init() {
+	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+// Handler checks every fabrik managed stack for drift, on a schedule, in the deployment
+// account and each deployment target.
+func Handler(event events.CloudWatchEvent) error {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln("recovered from panic:", r)
+		}
+	}()
+
+	// AWS session
+	sess := session.Must(session.NewSession())
+	log := log.WithFields(log.Fields{"event": event.ID})
+
+	secureStore := secure.NewAWSSecureStore(sess)
+	notifier, err := notify.Load(secureStore)
+	if err != nil {
+		log.Warnln("notifications disabled:", err.Error())
+	}
+
+	targets, err := target.Load(secureStore)
+	if err != nil && !secure.NotFound(err) {
+		log.Errorln("error loading deployment targets:", err.Error())
+		return nil
+	}
+
+	if targetSessions == nil {
+		targetSessions = target.NewSessions(sess, os.Getenv("ARTIFACT_STORE"))
+	}
+
+	store := drift.NewAWSDriftStore(sess, os.Getenv("DRIFT_TABLE"))
+
+	// leave time to record the results
+	deadline := time.Now().Add(0.8 * ExecutionTimeout * time.Second)
+	if err := Process(log, stack.NewAWSStackManager(log, sess), store, notifier, deadline); err != nil {
+		log.Errorln("error detecting drift:", err.Error())
+	}
+
+	// stages may share a target, which is only checked once
+	checked := make(map[string]bool)
+	for _, deployTarget := range targets {
+		location := fmt.Sprintf("%s/%s", target.Account(deployTarget), deployTarget.Region)
+		if checked[location] {
+			continue
+		}
+
+		checked[location] = true
+		log := log.WithField("target", location)
+
+		stackSession, err := targetSessions.Get(deployTarget)
+		if err != nil {
+			log.Errorln("error preparing deployment target:", err.Error())
+			continue
+		}
+
+		if err := Process(log, stack.NewAWSStackManager(log, stackSession), store, notifier, deadline); err != nil {
+			log.Errorln("error detecting drift:", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Process detects the drift of each managed stack and records it. Drifted stacks are
+// notified once, until their drift changes, which also resets any acknowledgement.
+func Process(log *log.Entry, manager types.StackManager, store types.DriftStore, notifier types.Notifier, deadline time.Time) error {
+	stacks, err := manager.Managed()
+	if err != nil {
+		return err
+	}
+
+	log.Infoln("detecting drift of", len(stacks), "stacks")
+
+	for _, current := range drift.Detect(log, manager, stacks, deadline) {
+		previous, err := store.Get(current.Stack)
+		if err != nil {
+			log.Warnln("could not get previous drift of", current.Stack+":", err.Error())
+		}
+
+		changed := previous == nil || previous.Fingerprint != current.Fingerprint
+		if !changed {
+			current.Acknowledged = previous.Acknowledged
+		}
+
+		if err := store.Save(current); err != nil {
+			log.Errorln("could not record drift of", current.Stack+":", err.Error())
+			continue
+		}
+
+		if current.Status != types.DriftStatusDrifted || !changed {
+			continue
+		}
+
+		log.Warnln(current.Stack, "drifted,", len(current.Resources), "resources")
+		if err := notifier.Notify(drift.Notification(current)); err != nil {
+			log.Warnln("could not notify drift of", current.Stack+":", err.Error())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,126 @@
+package drift
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+var (
+	ErrNoDrift = errors.New("no drift recorded for stack")
+)
+
+// AWSDriftStore records the drift of each stack in a DynamoDB table, keyed by 'stack'.
+type AWSDriftStore struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+// record is the stored form of a stack's drift, detected in unix seconds.
+type record struct {
+	Stack        string                `dynamodbav:"stack"`
+	Status       string                `dynamodbav:"status"`
+	Detected     int64                 `dynamodbav:"detected"`
+	Resources    []types.ResourceDrift `dynamodbav:"resources"`
+	Fingerprint  string                `dynamodbav:"fingerprint"`
+	Acknowledged string                `dynamodbav:"acknowledged"`
+}
+
+func NewAWSDriftStore(session *session.Session, table string) *AWSDriftStore {
+	return &AWSDriftStore{
+		client: dynamodb.New(session),
+		table:  table,
+	}
+}
+
+// Save replaces the stack's recorded drift.
+func (s *AWSDriftStore) Save(drift types.StackDrift) error {
+	item, err := dynamodbattribute.MarshalMap(record{
+		Stack:        drift.Stack,
+		Status:       drift.Status,
+		Detected:     drift.Detected.Unix(),
+		Resources:    drift.Resources,
+		Fingerprint:  drift.Fingerprint,
+		Acknowledged: drift.Acknowledged,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+
+	return err
+}
+
+// Get returns the stack's recorded drift, or nil if it was never checked.
+func (s *AWSDriftStore) Get(stack string) (*types.StackDrift, error) {
+	resp, err := s.client.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"stack": {S: aws.String(stack)},
+		},
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Item) == 0 {
+		return nil, nil
+	}
+
+	var r record
+	if err := dynamodbattribute.UnmarshalMap(resp.Item, &r); err != nil {
+		return nil, err
+	}
+
+	return &types.StackDrift{
+		Stack:        r.Stack,
+		Status:       r.Status,
+		Detected:     time.Unix(r.Detected, 0).UTC(),
+		Resources:    r.Resources,
+		Fingerprint:  r.Fingerprint,
+		Acknowledged: r.Acknowledged,
+	}, nil
+}
+
+// Acknowledge accepts the stack's recorded drift, on behalf of the given person.
+func (s *AWSDriftStore) Acknowledge(stack, by string) error {
+	_, err := s.client.UpdateItem(&dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"stack": {S: aws.String(stack)},
+		},
+		UpdateExpression:    aws.String("SET acknowledged = :by"),
+		ConditionExpression: aws.String("attribute_exists(#stack) AND #status = :drifted"),
+		ExpressionAttributeNames: map[string]*string{
+			"#stack":  aws.String("stack"),
+			"#status": aws.String("status"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":by":      {S: aws.String(by)},
+			":drifted": {S: aws.String(types.DriftStatusDrifted)},
+		},
+	})
+
+	if err != nil {
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			return ErrNoDrift
+		}
+
+		return err
+	}
+
+	return nil
+}
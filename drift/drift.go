@@ -0,0 +1,147 @@
+package drift
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Time between checks on the progress of drift detections
+	PollInterval = 5 * time.Second
+
+	// Property differences listed in a notification
+	ReportLines = 20
+)
+
+// Detect runs drift detection on the stacks at once, then waits for each detection to complete
+// until the deadline. Stacks whose detection fails, or doesn't complete in time, are left out.
+func Detect(log *log.Entry, manager types.StackManager, stacks []string, deadline time.Time) []types.StackDrift {
+	// detection id to stack name
+	pending := make(map[string]string)
+	for _, stack := range stacks {
+		id, err := manager.DetectDrift(stack)
+		if err != nil {
+			log.Warnln("could not start drift detection of", stack+":", err.Error())
+			continue
+		}
+
+		pending[id] = stack
+	}
+
+	drifts := make([]types.StackDrift, 0, len(pending))
+	for len(pending) > 0 {
+		for id, stack := range pending {
+			detection, err := manager.DriftDetection(id)
+			if err != nil {
+				log.Warnln("could not check drift detection of", stack+":", err.Error())
+				delete(pending, id)
+				continue
+			}
+
+			if detection.Status == types.DriftDetectionInProgress {
+				continue
+			}
+
+			delete(pending, id)
+
+			if detection.Status == types.DriftDetectionFailed {
+				log.Warnln("drift detection of", stack, "failed:", detection.Reason)
+				continue
+			}
+
+			drift := types.StackDrift{
+				Stack:    stack,
+				Status:   detection.DriftStatus,
+				Detected: time.Now().UTC(),
+			}
+
+			if drift.Status == types.DriftStatusDrifted {
+				if drift.Resources, err = manager.ResourceDrifts(stack); err != nil {
+					log.Warnln("could not describe drift of", stack+":", err.Error())
+					continue
+				}
+
+				drift.Fingerprint = Fingerprint(drift.Resources)
+			}
+
+			drifts = append(drifts, drift)
+		}
+
+		if len(pending) == 0 {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			log.Warnln(len(pending), "drift detections did not complete in time")
+			break
+		}
+
+		time.Sleep(PollInterval)
+	}
+
+	return drifts
+}
+
+// Fingerprint identifies a set of drifted resources and their property values, so that drift
+// which was already reported (and acknowledged) is recognized when it's detected again.
+func Fingerprint(resources []types.ResourceDrift) string {
+	lines := make([]string, 0)
+	for _, r := range resources {
+		lines = append(lines, r.LogicalId+" "+r.Status)
+		for _, d := range r.Differences {
+			lines = append(lines, strings.Join([]string{r.LogicalId, d.Path, d.Type, d.Expected, d.Actual}, " "))
+		}
+	}
+
+	sort.Strings(lines)
+	sum := sha256.Sum256([]byte(strings.Join(lines, "\n")))
+	return hex.EncodeToString(sum[:])
+}
+
+// Notification describes a stack's drift, listing its drifted resources and property differences.
+func Notification(drift types.StackDrift) types.Notification {
+	return types.Notification{
+		Event: types.NotifyEventStackDrifted,
+		Level: types.NotifyLevelWarning,
+		Title: fmt.Sprintf("Stack *%s* has drifted from its template", drift.Stack),
+		Text:  Report(drift.Resources, ReportLines),
+		Fields: map[string]string{
+			"stack":     drift.Stack,
+			"resources": strconv.Itoa(len(drift.Resources)),
+		},
+	}
+}
+
+// Report lists drifted resources and, up to the given number of lines, their property differences.
+func Report(resources []types.ResourceDrift, lines int) string {
+	report := make([]string, 0)
+	omitted := 0
+
+	for _, r := range resources {
+		report = append(report, fmt.Sprintf("• %s (%s) %s", r.LogicalId, r.Type, strings.ToLower(r.Status)))
+		for _, d := range r.Differences {
+			if lines <= 0 {
+				omitted++
+				continue
+			}
+
+			report = append(report, fmt.Sprintf("    %s %s: expected `%s`, actual `%s`", d.Path, strings.ToLower(d.Type), d.Expected, d.Actual))
+			lines--
+		}
+	}
+
+	if omitted > 0 {
+		report = append(report, fmt.Sprintf("...and %d more differences", omitted))
+	}
+
+	return strings.Join(report, "\n")
+}
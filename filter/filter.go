@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/ngmiller/fabrik/paths"
+	"github.com/ngmiller/fabrik/types"
+)
+
+// Defaults are applied after a repository's own filters, which may
+// override them with a 'build' filter.
+var Defaults = []types.BuildFilter{
+	types.BuildFilter{
+		Action: types.FilterActionSkip,
+		Reason: "ref requests no build",
+		Refs:   []string{"**/*NOBUILD*/**"},
+	},
+	types.BuildFilter{
+		Action:  types.FilterActionSkip,
+		Reason:  "commit message requests no build",
+		Message: `\[(skip ci|ci skip)\]`,
+	},
+}
+
+// Decide returns the first filter matching the push event, or nil if none match.
+// Changes lists the files changed by the push, nil if they are unknown, in which
+// case filters with path conditions do not match.
+func Decide(filters []types.BuildFilter, event types.GitHubEvent, changes []string) (*types.BuildFilter, error) {
+	for i := range filters {
+		ok, err := Match(filters[i], event, changes)
+		if err != nil {
+			return nil, err
+		}
+
+		if ok {
+			return &filters[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// Match reports whether every condition of the filter matches the push event.
+func Match(filter types.BuildFilter, event types.GitHubEvent, changes []string) (bool, error) {
+	if len(filter.Refs) == 0 && len(filter.Paths) == 0 && len(filter.OnlyPaths) == 0 &&
+		filter.Message == "" && len(filter.Authors) == 0 {
+		return false, nil
+	}
+
+	if len(filter.Refs) > 0 && !paths.MatchAny(filter.Refs, []string{refName(event.Ref)}) {
+		return false, nil
+	}
+
+	if len(filter.Paths) > 0 && (changes == nil || !paths.MatchAny(filter.Paths, changes)) {
+		return false, nil
+	}
+
+	if len(filter.OnlyPaths) > 0 && (changes == nil || !matchAll(filter.OnlyPaths, changes)) {
+		return false, nil
+	}
+
+	head := headCommit(event)
+
+	if filter.Message != "" {
+		pattern, err := regexp.Compile(filter.Message)
+		if err != nil {
+			return false, err
+		}
+
+		if head == nil || !pattern.MatchString(head.Message) {
+			return false, nil
+		}
+	}
+
+	if len(filter.Authors) > 0 && (head == nil || !matchAuthor(filter.Authors, *head)) {
+		return false, nil
+	}
+
+	return true, nil
+}
+
+//
+// Helpers
+//
+
+// refName strips the 'refs/heads/' or 'refs/tags/' prefix from a ref
+func refName(ref string) string {
+	for _, prefix := range []string{"refs/heads/", "refs/tags/"} {
+		if strings.HasPrefix(ref, prefix) {
+			return strings.TrimPrefix(ref, prefix)
+		}
+	}
+
+	return ref
+}
+
+// headCommit - the head commit of the push, nil if the push has no commits
+func headCommit(event types.GitHubEvent) *types.GitHubCommit {
+	if event.HeadCommit != nil {
+		return event.HeadCommit
+	}
+
+	if len(event.Commits) == 0 {
+		return nil
+	}
+
+	return &event.Commits[len(event.Commits)-1]
+}
+
+func matchAll(patterns, names []string) bool {
+	for _, name := range names {
+		if !paths.MatchAny(patterns, []string{name}) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func matchAuthor(authors []string, commit types.GitHubCommit) bool {
+	for _, author := range authors {
+		if author == commit.Author.Username || author == commit.Author.Name || author == commit.Author.Email {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,108 @@
+package filter
+
+import (
+	"testing"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+func push(ref, message string, files ...string) types.GitHubEvent {
+	commit := types.GitHubCommit{Message: message, Modified: files}
+	commit.Author.Username = "octocat"
+	commit.Author.Email = "octocat@example.com"
+
+	return types.GitHubEvent{
+		Ref:        ref,
+		Commits:    []types.GitHubCommit{commit},
+		HeadCommit: &commit,
+	}
+}
+
+func TestDecideDefaults(t *testing.T) {
+	cases := []struct {
+		name   string
+		event  types.GitHubEvent
+		reason string
+	}{
+		{"plain push", push("refs/heads/feature", "add endpoint"), ""},
+		{"NOBUILD branch", push("refs/heads/NOBUILD-docs", "add endpoint"), "ref requests no build"},
+		{"nested NOBUILD branch", push("refs/heads/docs/wip-NOBUILD", "add endpoint"), "ref requests no build"},
+		{"NOBUILD tag", push("refs/tags/NOBUILD", "add endpoint"), "ref requests no build"},
+		{"lowercase nobuild", push("refs/heads/nobuild", "add endpoint"), ""},
+		{"skip ci", push("refs/heads/feature", "fix typo [skip ci]"), "commit message requests no build"},
+		{"ci skip", push("refs/heads/feature", "[ci skip] fix typo"), "commit message requests no build"},
+		{"skip ci without brackets", push("refs/heads/feature", "skip ci"), ""},
+		{"no commits", types.GitHubEvent{Ref: "refs/heads/feature"}, ""},
+	}
+
+	for _, c := range cases {
+		decision, err := Decide(Defaults, c.event, nil)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err.Error())
+		}
+
+		reason := ""
+		if decision != nil {
+			reason = decision.Reason
+			if decision.Action != types.FilterActionSkip {
+				t.Errorf("%s: action %q, want skip", c.name, decision.Action)
+			}
+		}
+
+		if reason != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, reason, c.reason)
+		}
+	}
+}
+
+func TestDecideOrder(t *testing.T) {
+	filters := append([]types.BuildFilter{
+		{Action: types.FilterActionBuild, Reason: "always build releases", Refs: []string{"release/*"}},
+		{Action: types.FilterActionSkip, Reason: "docs only", OnlyPaths: []string{"docs/**", "**/*.md"}},
+		{Action: types.FilterActionSkip, Reason: "bot", Authors: []string{"octocat@example.com"}, Paths: []string{"vendor/", "!vendor/modules.txt"}},
+	}, Defaults...)
+
+	cases := []struct {
+		name    string
+		event   types.GitHubEvent
+		changes []string
+		reason  string
+	}{
+		{"repo filter overrides default", push("refs/heads/release/NOBUILD", "[skip ci]"), nil, "always build releases"},
+		{"docs only", push("refs/heads/feature", "docs"), []string{"docs/intro.md", "README.md"}, "docs only"},
+		{"docs and code", push("refs/heads/feature", "docs"), []string{"docs/intro.md", "main.go"}, ""},
+		{"unknown changes", push("refs/heads/feature", "docs"), nil, ""},
+		{"bot vendor update", push("refs/heads/feature", "bump"), []string{"vendor/lib/a.go"}, "bot"},
+		{"bot excluded vendor file", push("refs/heads/feature", "bump"), []string{"vendor/modules.txt"}, ""},
+		{"default still applies", push("refs/heads/feature", "wip [ci skip]"), []string{"main.go"}, "commit message requests no build"},
+	}
+
+	for _, c := range cases {
+		decision, err := Decide(filters, c.event, c.changes)
+		if err != nil {
+			t.Fatalf("%s: %s", c.name, err.Error())
+		}
+
+		reason := ""
+		if decision != nil {
+			reason = decision.Reason
+		}
+
+		if reason != c.reason {
+			t.Errorf("%s: reason %q, want %q", c.name, reason, c.reason)
+		}
+	}
+}
+
+func TestMatchEmptyFilter(t *testing.T) {
+	ok, err := Match(types.BuildFilter{Action: types.FilterActionSkip}, push("refs/heads/feature", "x"), []string{"a"})
+	if err != nil || ok {
+		t.Errorf("empty filter matched: %v, %v", ok, err)
+	}
+}
+
+func TestMatchInvalidMessage(t *testing.T) {
+	if _, err := Match(types.BuildFilter{Message: "("}, push("refs/heads/feature", "x"), nil); err == nil {
+		t.Error("invalid message pattern should fail")
+	}
+}
@@ -0,0 +1,93 @@
+package health
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/ecs"
+)
+
+type AWSHealthChecker struct {
+	http       *http.Client
+	cloudwatch *cloudwatch.CloudWatch
+	ecs        *ecs.ECS
+}
+
+func NewAWSHealthChecker(session *session.Session) *AWSHealthChecker {
+	return &AWSHealthChecker{
+		http:       &http.Client{Timeout: 10 * time.Second},
+		cloudwatch: cloudwatch.New(session),
+		ecs:        ecs.New(session),
+	}
+}
+
+// Endpoint requests the URL, returning an error unless it responds with the status.
+func (c *AWSHealthChecker) Endpoint(url string, status int) error {
+	resp, err := c.http.Get(url)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode != status {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+
+	return nil
+}
+
+// Alarms returns the names of the given alarms which are firing.
+func (c *AWSHealthChecker) Alarms(names []string) ([]string, error) {
+	firing := make([]string, 0)
+	if len(names) == 0 {
+		return firing, nil
+	}
+
+	// at most 100 alarms are described at once
+	for start := 0; start < len(names); start += 100 {
+		end := start + 100
+		if end > len(names) {
+			end = len(names)
+		}
+
+		resp, err := c.cloudwatch.DescribeAlarms(&cloudwatch.DescribeAlarmsInput{
+			AlarmNames: aws.StringSlice(names[start:end]),
+			StateValue: aws.String(cloudwatch.StateValueAlarm),
+		})
+
+		if err != nil {
+			return nil, err
+		}
+
+		for _, alarm := range resp.MetricAlarms {
+			firing = append(firing, aws.StringValue(alarm.AlarmName))
+		}
+	}
+
+	return firing, nil
+}
+
+// ServiceStable reports whether an ECS service has finished deploying, with a single
+// deployment running its desired number of tasks.
+func (c *AWSHealthChecker) ServiceStable(cluster, service string) (bool, error) {
+	resp, err := c.ecs.DescribeServices(&ecs.DescribeServicesInput{
+		Cluster:  aws.String(cluster),
+		Services: aws.StringSlice([]string{service}),
+	})
+
+	if err != nil {
+		return false, err
+	}
+
+	if len(resp.Services) == 0 {
+		return false, fmt.Errorf("service %s not found in cluster %s", service, cluster)
+	}
+
+	s := resp.Services[0]
+	return len(s.Deployments) == 1 && aws.Int64Value(s.RunningCount) == aws.Int64Value(s.DesiredCount), nil
+}
@@ -0,0 +1,82 @@
+package health
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+// Evaluate runs a round of health checks against a stack's outputs. A firing alarm, or a
+// missing output, fails the check with an error. Otherwise, the reason the stack isn't
+// healthy yet is returned, or empty once it's healthy.
+func Evaluate(checker types.HealthChecker, config types.HealthCheckConfig, outputs map[string]string) (string, error) {
+	alarms := append([]string{}, config.Alarms...)
+	for _, alarmOutput := range config.AlarmOutputs {
+		name, err := output(outputs, alarmOutput)
+		if err != nil {
+			return "", err
+		}
+
+		alarms = append(alarms, name)
+	}
+
+	firing, err := checker.Alarms(alarms)
+	if err != nil {
+		return "", err
+	}
+
+	if len(firing) > 0 {
+		return "", fmt.Errorf("alarms firing: %s", strings.Join(firing, ", "))
+	}
+
+	if len(config.ServiceOutputs) > 0 {
+		cluster, err := output(outputs, config.ClusterOutput)
+		if err != nil {
+			return "", err
+		}
+
+		for _, serviceOutput := range config.ServiceOutputs {
+			service, err := output(outputs, serviceOutput)
+			if err != nil {
+				return "", err
+			}
+
+			stable, err := checker.ServiceStable(cluster, service)
+			if err != nil {
+				return "", err
+			}
+
+			if !stable {
+				return fmt.Sprintf("service %s is not stable", service), nil
+			}
+		}
+	}
+
+	if config.UrlOutput != "" {
+		url, err := output(outputs, config.UrlOutput)
+		if err != nil {
+			return "", err
+		}
+
+		if err := checker.Endpoint(strings.TrimRight(url, "/")+config.Path, config.ExpectedStatus); err != nil {
+			return err.Error(), nil
+		}
+	}
+
+	return "", nil
+}
+
+//
+// Helpers
+//
+
+func output(outputs map[string]string, name string) (string, error) {
+	value, ok := outputs[name]
+	if !ok || value == "" {
+		return "", errors.New("stack has no output " + name)
+	}
+
+	return value, nil
+}
@@ -0,0 +1,453 @@
+package history
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// Index of executions by repository and environment, sorted by start time
+	EnvironmentIndex = "repo_environment-started-index"
+)
+
+var (
+	ErrDeploymentNotFound = errors.New("deployment not found")
+)
+
+// AWSHistoryStore records pipeline executions in a DynamoDB table, keyed by execution id
+// and source repository. Times are stored as unix seconds.
+type AWSHistoryStore struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+// record is the stored form of an execution. Stage details are kept in flat maps, keyed
+// by stage name, so that each stage event can update its own entries.
+type record struct {
+	Id              string            `dynamodbav:"id"`
+	Repo            string            `dynamodbav:"repo"`
+	Pipeline        string            `dynamodbav:"pipeline"`
+	Ref             string            `dynamodbav:"ref"`
+	Commit          string            `dynamodbav:"commit"`
+	Environment     string            `dynamodbav:"environment"`
+	RepoEnvironment string            `dynamodbav:"repo_environment"`
+	State           string            `dynamodbav:"state"`
+	Committed       int64             `dynamodbav:"committed"`
+	Started         int64             `dynamodbav:"started"`
+	Finished        int64             `dynamodbav:"finished"`
+	StageStates     map[string]string `dynamodbav:"stage_states"`
+	StageStarted    map[string]int64  `dynamodbav:"stage_started"`
+	StageFinished   map[string]int64  `dynamodbav:"stage_finished"`
+}
+
+func NewAWSHistoryStore(session *session.Session, table string) *AWSHistoryStore {
+	return &AWSHistoryStore{
+		client: dynamodb.New(session),
+		table:  table,
+	}
+}
+
+// Record writes the known details of an execution, leaving previously recorded details
+// (and stages) in place. Events may arrive in any order, so empty values are skipped.
+func (s *AWSHistoryStore) Record(execution types.PipelineExecution) error {
+	update := &updateExpression{values: map[string]*dynamodb.AttributeValue{}, names: map[string]*string{}}
+
+	update.setString("pipeline", execution.Pipeline)
+	update.setString("ref", execution.Ref)
+	update.setString("commit", execution.Commit)
+	update.setString("state", execution.State)
+	update.setTime("committed", execution.Committed)
+	update.setTime("started", execution.Started)
+	update.setTime("finished", execution.Finished)
+
+	if execution.Environment != "" {
+		update.setString("environment", execution.Environment)
+		update.setString("repo_environment", repoEnvironment(execution.Repo, execution.Environment))
+	}
+
+	if len(update.sets) == 0 {
+		return nil
+	}
+
+	return s.update(execution.Id, execution.Repo, update)
+}
+
+// RecordStage writes the state of a stage within an execution.
+func (s *AWSHistoryStore) RecordStage(id, repo string, stage types.StageExecution) error {
+	// nested attributes can only be set once their maps exist
+	empty := &dynamodb.AttributeValue{M: map[string]*dynamodb.AttributeValue{}}
+	init := &updateExpression{values: map[string]*dynamodb.AttributeValue{":empty": empty}, names: map[string]*string{}}
+	for _, attribute := range []string{"stage_states", "stage_started", "stage_finished"} {
+		init.sets = append(init.sets, attribute+" = if_not_exists("+attribute+", :empty)")
+	}
+
+	if err := s.update(id, repo, init); err != nil {
+		return err
+	}
+
+	update := &updateExpression{
+		values: map[string]*dynamodb.AttributeValue{},
+		names:  map[string]*string{"#stage": aws.String(stage.Name)},
+	}
+
+	update.setString("stage_states.#stage", stage.State)
+	update.setTime("stage_started.#stage", stage.Started)
+	update.setTime("stage_finished.#stage", stage.Finished)
+
+	return s.update(id, repo, update)
+}
+
+// Executions returns the executions of a repository's pipelines in an environment which
+// started after the given time, oldest first.
+func (s *AWSHistoryStore) Executions(repo, environment string, since time.Time) ([]types.PipelineExecution, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(EnvironmentIndex),
+		KeyConditionExpression: aws.String("#key = :key AND #started >= :since"),
+		ExpressionAttributeNames: map[string]*string{
+			"#key":     aws.String("repo_environment"),
+			"#started": aws.String("started"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":key":   {S: aws.String(repoEnvironment(repo, environment))},
+			":since": {N: aws.String(strconv.FormatInt(since.Unix(), 10))},
+		},
+	}
+
+	executions := make([]types.PipelineExecution, 0)
+	for {
+		resp, err := s.client.Query(input)
+		if err != nil {
+			return nil, err
+		}
+
+		var records []record
+		if err := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &records); err != nil {
+			return nil, err
+		}
+
+		for _, r := range records {
+			executions = append(executions, r.execution())
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	return executions, nil
+}
+
+// AWSDeploymentStore records deployments in a DynamoDB table, keyed by stack and deployment
+// time in unix seconds, which also serves as the deployment id. Templates can exceed the
+// size of an item, so they're kept in an S3 bucket under 'deployments/{stack}/{id}'.
+type AWSDeploymentStore struct {
+	dynamo  *dynamodb.DynamoDB
+	s3      *s3.S3
+	table   string
+	bucket  string
+	account string
+	region  string
+}
+
+// deploymentRecord is the stored form of a deployment.
+type deploymentRecord struct {
+	Stack      string            `dynamodbav:"stack"`
+	Deployed   int64             `dynamodbav:"deployed"`
+	Repo       string            `dynamodbav:"repo"`
+	Ref        string            `dynamodbav:"ref"`
+	Commit     string            `dynamodbav:"commit"`
+	Account    string            `dynamodbav:"account,omitempty"`
+	Region     string            `dynamodbav:"region,omitempty"`
+	Parameters []types.Parameter `dynamodbav:"parameters"`
+	Template   string            `dynamodbav:"template"`
+}
+
+func NewAWSDeploymentStore(session *session.Session, table, bucket string) *AWSDeploymentStore {
+	return &AWSDeploymentStore{
+		dynamo: dynamodb.New(session),
+		s3:     s3.New(session),
+		table:  table,
+		bucket: bucket,
+	}
+}
+
+// WithTarget records the deployments saved through the store as deployed to the account and
+// region of a deployment target.
+func (s *AWSDeploymentStore) WithTarget(account, region string) *AWSDeploymentStore {
+	s.account, s.region = account, region
+	return s
+}
+
+// Save records a deployment, its id is taken from the deployment time.
+func (s *AWSDeploymentStore) Save(deployment types.Deployment) error {
+	if deployment.Account == "" {
+		deployment.Account, deployment.Region = s.account, s.region
+	}
+
+	deployed := deployment.Deployed.Unix()
+	key := templateKey(deployment.Stack, deployed)
+
+	_, err := s.s3.PutObject(&s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+		Body:   bytes.NewReader(deployment.Template),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	item, err := dynamodbattribute.MarshalMap(deploymentRecord{
+		Stack:      deployment.Stack,
+		Deployed:   deployed,
+		Repo:       deployment.Repo,
+		Ref:        deployment.Ref,
+		Commit:     deployment.Commit,
+		Account:    deployment.Account,
+		Region:     deployment.Region,
+		Parameters: deployment.Parameters,
+		Template:   key,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.dynamo.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+
+	return err
+}
+
+// List returns a stack's deployments, newest first.
+func (s *AWSDeploymentStore) List(stack string) ([]types.Deployment, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		KeyConditionExpression: aws.String("#stack = :stack"),
+		ExpressionAttributeNames: map[string]*string{
+			"#stack": aws.String("stack"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":stack": {S: aws.String(stack)},
+		},
+		ScanIndexForward: aws.Bool(false),
+	}
+
+	deployments := make([]types.Deployment, 0)
+	for {
+		resp, err := s.dynamo.Query(input)
+		if err != nil {
+			return nil, err
+		}
+
+		var records []deploymentRecord
+		if err := dynamodbattribute.UnmarshalListOfMaps(resp.Items, &records); err != nil {
+			return nil, err
+		}
+
+		for _, r := range records {
+			deployments = append(deployments, r.deployment())
+		}
+
+		if len(resp.LastEvaluatedKey) == 0 {
+			break
+		}
+
+		input.ExclusiveStartKey = resp.LastEvaluatedKey
+	}
+
+	return deployments, nil
+}
+
+// Get returns a deployment of a stack, with its template.
+func (s *AWSDeploymentStore) Get(stack, id string) (types.Deployment, error) {
+	// ids are deployment times
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		return types.Deployment{}, ErrDeploymentNotFound
+	}
+
+	resp, err := s.dynamo.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"stack":    {S: aws.String(stack)},
+			"deployed": {N: aws.String(id)},
+		},
+	})
+
+	if err != nil {
+		return types.Deployment{}, err
+	}
+
+	if len(resp.Item) == 0 {
+		return types.Deployment{}, ErrDeploymentNotFound
+	}
+
+	var r deploymentRecord
+	if err := dynamodbattribute.UnmarshalMap(resp.Item, &r); err != nil {
+		return types.Deployment{}, err
+	}
+
+	object, err := s.s3.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(r.Template),
+	})
+
+	if err != nil {
+		return types.Deployment{}, err
+	}
+
+	defer object.Body.Close()
+
+	deployment := r.deployment()
+	if deployment.Template, err = ioutil.ReadAll(object.Body); err != nil {
+		return types.Deployment{}, err
+	}
+
+	return deployment, nil
+}
+
+//
+// Helpers
+//
+
+// updateExpression collects the SET clauses of an UpdateItem request.
+type updateExpression struct {
+	sets   []string
+	values map[string]*dynamodb.AttributeValue
+	names  map[string]*string
+}
+
+func (u *updateExpression) set(path string, value *dynamodb.AttributeValue) {
+	placeholder := ":v" + strconv.Itoa(len(u.values))
+
+	// 'state' and 'commit' are among DynamoDB's reserved words, so name every attribute
+	name := "#a" + strconv.Itoa(len(u.names))
+	parts := strings.SplitN(path, ".", 2)
+	u.names[name] = aws.String(parts[0])
+	if len(parts) == 2 {
+		name += "." + parts[1]
+	}
+
+	u.values[placeholder] = value
+	u.sets = append(u.sets, name+" = "+placeholder)
+}
+
+func (u *updateExpression) setString(path, value string) {
+	if value == "" {
+		return
+	}
+
+	u.set(path, &dynamodb.AttributeValue{S: aws.String(value)})
+}
+
+func (u *updateExpression) setTime(path string, value *time.Time) {
+	if value == nil {
+		return
+	}
+
+	u.set(path, &dynamodb.AttributeValue{N: aws.String(strconv.FormatInt(value.Unix(), 10))})
+}
+
+func (u *updateExpression) String() string {
+	return "SET " + strings.Join(u.sets, ", ")
+}
+
+func (s *AWSHistoryStore) update(id, repo string, update *updateExpression) error {
+	input := &dynamodb.UpdateItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id":   {S: aws.String(id)},
+			"repo": {S: aws.String(repo)},
+		},
+		UpdateExpression:          aws.String(update.String()),
+		ExpressionAttributeValues: update.values,
+	}
+
+	if len(update.names) > 0 {
+		input.ExpressionAttributeNames = update.names
+	}
+
+	_, err := s.client.UpdateItem(input)
+	return err
+}
+
+func (r record) execution() types.PipelineExecution {
+	execution := types.PipelineExecution{
+		Id:          r.Id,
+		Pipeline:    r.Pipeline,
+		Repo:        r.Repo,
+		Ref:         r.Ref,
+		Commit:      r.Commit,
+		Environment: r.Environment,
+		State:       r.State,
+		Committed:   unixTime(r.Committed),
+		Started:     unixTime(r.Started),
+		Finished:    unixTime(r.Finished),
+		Stages:      make([]types.StageExecution, 0, len(r.StageStates)),
+	}
+
+	for name, state := range r.StageStates {
+		execution.Stages = append(execution.Stages, types.StageExecution{
+			Name:     name,
+			State:    state,
+			Started:  unixTime(r.StageStarted[name]),
+			Finished: unixTime(r.StageFinished[name]),
+		})
+	}
+
+	// stages in the order they ran
+	sort.Slice(execution.Stages, func(i, j int) bool {
+		return r.StageStarted[execution.Stages[i].Name] < r.StageStarted[execution.Stages[j].Name]
+	})
+
+	return execution
+}
+
+func unixTime(seconds int64) *time.Time {
+	if seconds == 0 {
+		return nil
+	}
+
+	t := time.Unix(seconds, 0).UTC()
+	return &t
+}
+
+func repoEnvironment(repo, environment string) string {
+	return repo + "/" + environment
+}
+
+func (r deploymentRecord) deployment() types.Deployment {
+	return types.Deployment{
+		Id:         strconv.FormatInt(r.Deployed, 10),
+		Stack:      r.Stack,
+		Repo:       r.Repo,
+		Ref:        r.Ref,
+		Commit:     r.Commit,
+		Deployed:   time.Unix(r.Deployed, 0).UTC(),
+		Account:    r.Account,
+		Region:     r.Region,
+		Parameters: r.Parameters,
+	}
+}
+
+func templateKey(stack string, deployed int64) string {
+	return "deployments/" + stack + "/" + strconv.FormatInt(deployed, 10)
+}
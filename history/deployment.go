@@ -0,0 +1,35 @@
+package history
+
+import (
+	"github.com/ngmiller/fabrik/types"
+)
+
+// Redact masks the values of secret parameters before they're recorded with a deployment.
+// NoEcho parameters are already masked by CloudFormation, the repository token never is.
+func Redact(parameters []types.Parameter) []types.Parameter {
+	redacted := make([]types.Parameter, 0, len(parameters))
+	for _, p := range parameters {
+		if p.ParameterKey == types.ParameterRepoToken {
+			p.ParameterValue = types.ParameterMasked
+		}
+
+		redacted = append(redacted, p)
+	}
+
+	return redacted
+}
+
+// Restore prepares a deployment's parameters for a stack update. Redacted values
+// can't be restored, so the stack keeps its current value for them.
+func Restore(parameters []types.Parameter) []types.Parameter {
+	restored := make([]types.Parameter, 0, len(parameters))
+	for _, p := range parameters {
+		if p.ParameterValue == types.ParameterMasked {
+			p = types.Parameter{ParameterKey: p.ParameterKey, UsePreviousValue: true}
+		}
+
+		restored = append(restored, p)
+	}
+
+	return restored
+}
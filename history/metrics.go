@@ -0,0 +1,59 @@
+package history
+
+import (
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+// Summarize computes delivery metrics for a repository's executions in an environment.
+// Executions which never finished (canceled, superseded or still running) count towards
+// the total, but not towards failure rate, duration or lead time.
+func Summarize(repo, environment string, executions []types.PipelineExecution) types.PipelineMetrics {
+	metrics := types.PipelineMetrics{
+		Repo:        repo,
+		Environment: environment,
+		Executions:  len(executions),
+	}
+
+	var duration, leadTime time.Duration
+	var durations, leadTimes int
+
+	for _, execution := range executions {
+		switch execution.State {
+		case types.PipelineStateSucceeded:
+			metrics.Succeeded++
+
+			// lead time only counts changes which made it out
+			if t := execution.LeadTime(); t > 0 {
+				leadTime += t
+				leadTimes++
+			}
+
+		case types.PipelineStateFailed:
+			metrics.Failed++
+
+		default:
+			continue
+		}
+
+		if d := execution.Duration(); d > 0 {
+			duration += d
+			durations++
+		}
+	}
+
+	if finished := metrics.Succeeded + metrics.Failed; finished > 0 {
+		metrics.FailureRate = float64(metrics.Failed) / float64(finished)
+	}
+
+	if durations > 0 {
+		metrics.MeanDuration = (duration / time.Duration(durations)).Round(time.Second).String()
+	}
+
+	if leadTimes > 0 {
+		metrics.MeanLeadTime = (leadTime / time.Duration(leadTimes)).Round(time.Second).String()
+	}
+
+	return metrics
+}
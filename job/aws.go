@@ -0,0 +1,146 @@
+package job
+
+import (
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	// Jobs not resumed by then are abandoned
+	JobExpiration = 24 * time.Hour
+)
+
+// AWSJobStore keeps jobs in a DynamoDB table, keyed by 'stack'. A stack has at most one job,
+// the latest push's. Jobs expire with the table's 'ttl' attribute.
+type AWSJobStore struct {
+	client *dynamodb.DynamoDB
+	table  string
+}
+
+// record is the stored form of a job, created in unix seconds.
+type record struct {
+	Stack      string `dynamodbav:"stack"`
+	Service    string `dynamodbav:"service"`
+	Deployment int64  `dynamodbav:"deployment"`
+	Payload    string `dynamodbav:"payload"`
+	Created    int64  `dynamodbav:"created"`
+	TTL        int64  `dynamodbav:"ttl"`
+	Account    string `dynamodbav:"account,omitempty"`
+	Region     string `dynamodbav:"region,omitempty"`
+}
+
+func NewAWSJobStore(session *session.Session, table string) *AWSJobStore {
+	return &AWSJobStore{
+		client: dynamodb.New(session),
+		table:  table,
+	}
+}
+
+// Save keeps a job, replacing any previous job for its stack.
+func (s *AWSJobStore) Save(job types.StackJob) error {
+	item, err := dynamodbattribute.MarshalMap(record{
+		Stack:      job.Stack,
+		Service:    job.Service,
+		Deployment: job.Deployment,
+		Payload:    job.Payload,
+		Created:    job.Created.Unix(),
+		TTL:        job.Created.Add(JobExpiration).Unix(),
+		Account:    job.Account,
+		Region:     job.Region,
+	})
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.client.PutItem(&dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item:      item,
+	})
+
+	return err
+}
+
+// Take removes and returns the stack's job. Only one caller gets a job, so it's
+// resumed once when both its stack event and a sweep find it.
+func (s *AWSJobStore) Take(stack string) (*types.StackJob, error) {
+	resp, err := s.client.DeleteItem(&dynamodb.DeleteItemInput{
+		TableName: aws.String(s.table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"stack": {S: aws.String(stack)},
+		},
+		ReturnValues: aws.String(dynamodb.ReturnValueAllOld),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(resp.Attributes) == 0 {
+		return nil, nil
+	}
+
+	var r record
+	if err := dynamodbattribute.UnmarshalMap(resp.Attributes, &r); err != nil {
+		return nil, err
+	}
+
+	job := r.job()
+	return &job, nil
+}
+
+// Pending returns every job which hasn't been resumed.
+func (s *AWSJobStore) Pending() ([]types.StackJob, error) {
+	jobs := make([]types.StackJob, 0)
+
+	var decodeErr error
+	err := s.client.ScanPages(&dynamodb.ScanInput{TableName: aws.String(s.table)},
+		func(page *dynamodb.ScanOutput, last bool) bool {
+			var records []record
+			if decodeErr = dynamodbattribute.UnmarshalListOfMaps(page.Items, &records); decodeErr != nil {
+				return false
+			}
+
+			now := time.Now().Unix()
+			for _, r := range records {
+				// expired items linger until they're deleted
+				if r.TTL > now {
+					jobs = append(jobs, r.job())
+				}
+			}
+
+			return true
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if decodeErr != nil {
+		return nil, decodeErr
+	}
+
+	return jobs, nil
+}
+
+//
+// Helpers
+//
+
+func (r record) job() types.StackJob {
+	return types.StackJob{
+		Stack:      r.Stack,
+		Service:    r.Service,
+		Deployment: r.Deployment,
+		Payload:    r.Payload,
+		Created:    time.Unix(r.Created, 0).UTC(),
+		Account:    r.Account,
+		Region:     r.Region,
+	}
+}
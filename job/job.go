@@ -0,0 +1,72 @@
+package job
+
+import (
+	"encoding/json"
+
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+const (
+	// Attribute of a builder event holding the jobs it resumes
+	ResumeAttribute = "resume"
+)
+
+// ResumeEvent creates a builder event which resumes the jobs of a push, picking up each
+// service's stack where the previous invocation left off. Jobs must share a payload.
+func ResumeEvent(jobs []types.StackJob) (events.DynamoDBEvent, error) {
+	encoded, err := json.Marshal(jobs)
+	if err != nil {
+		return events.DynamoDBEvent{}, err
+	}
+
+	return events.DynamoDBEvent{
+		Records: []events.DynamoDBEventRecord{
+			{
+				EventName: types.DynamoDBEventInsert,
+				Change: events.DynamoDBStreamRecord{
+					NewImage: map[string]events.DynamoDBAttributeValue{
+						"type":          events.NewStringAttribute(types.EventTypePush),
+						"payload":       events.NewStringAttribute(jobs[0].Payload),
+						ResumeAttribute: events.NewStringAttribute(string(encoded)),
+					},
+				},
+			},
+		},
+	}, nil
+}
+
+// ReplayEvent creates a builder event which processes a stored delivery again, as if
+// it had just been received.
+func ReplayEvent(delivery types.Delivery) events.DynamoDBEvent {
+	return events.DynamoDBEvent{
+		Records: []events.DynamoDBEventRecord{
+			{
+				EventName: types.DynamoDBEventInsert,
+				Change: events.DynamoDBStreamRecord{
+					NewImage: map[string]events.DynamoDBAttributeValue{
+						"id":      events.NewStringAttribute(delivery.Id),
+						"type":    events.NewStringAttribute(delivery.Type),
+						"payload": events.NewStringAttribute(delivery.Payload),
+					},
+				},
+			},
+		},
+	}
+}
+
+// Resumed returns the jobs resumed by a builder event, or nil for new events.
+func Resumed(image map[string]events.DynamoDBAttributeValue) ([]types.StackJob, error) {
+	value, ok := image[ResumeAttribute]
+	if !ok || value.DataType() != events.DataTypeString {
+		return nil, nil
+	}
+
+	var jobs []types.StackJob
+	if err := json.Unmarshal([]byte(value.String()), &jobs); err != nil {
+		return nil, err
+	}
+
+	return jobs, nil
+}
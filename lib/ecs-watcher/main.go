@@ -3,24 +3,21 @@ package main
 import (
 	"encoding/json"
 	"fmt"
+	"strings"
 
-	"github.com/opolis/build/secure"
-	"github.com/opolis/build/stack"
-	"github.com/opolis/build/types"
+	"github.com/ngmiller/fabrik/container"
+	"github.com/ngmiller/fabrik/notify"
+	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/stack"
+	"github.com/ngmiller/fabrik/types"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/nlopes/slack"
 
 	log "github.com/sirupsen/logrus"
 )
 
-const (
-	tokenKey  = "bot.slack.token"
-	channelID = "CCDAY0552"
-)
-
 func init() {
 	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
 }
@@ -54,46 +51,136 @@ func Handler(raw events.CloudWatchEvent) error {
 		return nil
 	}
 
-	log := log.WithFields(log.Fields{"container": event.Containers[0].Name})
-	manager := stack.NewAWSStackManager(log, sess)
+	log := log.WithFields(log.Fields{"task": event.TaskArn, "group": event.Group})
+	stackManager := stack.NewAWSStackManager(log, sess)
+	containerManager := container.NewAWSContainerManager(sess)
 
-	// Slack OAuth token
+	// notification routes
 	secureStore := secure.NewAWSSecureStore(sess)
-	token, err := secureStore.Get(tokenKey)
+	notifier, err := notify.Load(secureStore)
 	if err != nil {
-		log.Errorln("could not fetch slack token:", err.Error())
+		log.Warnln("notifications disabled:", err.Error())
+	}
+
+	if err := Process(log, event, stackManager, containerManager, notifier); err != nil {
+		log.Errorln("error processing event:", err.Error())
+	}
+
+	return nil
+}
+
+// Process cancels the update of the stack owning a task whose essential containers failed,
+// rolling back the deployment which introduced them. Failures outside of an update are only
+// reported. The stack is found from the task's service, or its task definition, as either
+// may be a stack resource.
+func Process(log *log.Entry, event types.ECSEvent, stacks types.StackManager, containers types.ContainerManager, notifier types.Notifier) error {
+	// tasks stopped for any other reason, i.e. replaced during a rolling deployment, didn't fail
+	if event.StoppedReason != types.EcsFailureReason {
+		log.Infoln("task not stopped by an essential container exit - no action")
+		return nil
+	}
+
+	failed := failedContainers(log, event, containers)
+	if len(failed) == 0 {
+		log.Infoln("no essential container failed - no action")
 		return nil
 	}
 
-	// Request stack update rollback if container failed to start.
-	// Note: this will also capture events when containers fail outside of an update context. In that case,
-	// we just allow this function to exit gracefully and fire off an event to slack.
-	if (event.Containers[0].LastStatus == types.EcsStateStopped) && (event.StoppedReason == types.EcsFailureReason) {
-		// TODO: we are assuming the container name corresponds to the cloudformation stack name
-		// this has been true for Opolis deploys, but will need a better generalization in the future
-		if err := manager.CancelUpdate(event.Containers[0].Name); err != nil {
-			log.Errorln("error cancelling stack update:", err.Error())
-			return nil
+	log = log.WithField("containers", strings.Join(failed, ","))
+
+	name, err := owner(event, stacks, containers)
+	if err != nil {
+		return err
+	}
+
+	action := "task is not part of a stack"
+	if name != "" {
+		log = log.WithField("stack", name)
+
+		_, status, err := stacks.Status(name)
+		if err != nil {
+			return err
 		}
 
-		if err := PostMessage(token, event.Containers[0].Name, event.TaskArn); err != nil {
-			log.Errorln("error posting message to slack:", err.Error())
-			return nil
+		action = fmt.Sprintf("no update in progress (%s)", status)
+		if status == types.StackStatusUpdateInProgress {
+			if err := stacks.CancelUpdate(name); err != nil {
+				return err
+			}
+
+			action = "update cancelled"
 		}
 	}
 
-	return nil
+	log.Infoln("essential containers failed:", action)
+	return PostMessage(notifier, name, event.TaskArn, failed, action)
 }
 
-func PostMessage(token, stack, taskArn string) error {
-	// slack session
-	api := slack.New(token)
+func PostMessage(notifier types.Notifier, stack, taskArn string, containers []string, action string) error {
+	title := "Container failed to start"
+	if stack != "" {
+		title += fmt.Sprintf(" for *%s*", stack)
+	}
 
-	msg := fmt.Sprintf("<!channel> Container failed to start for *%s* (%s)", stack, taskArn)
-	params := slack.PostMessageParameters{
-		Markdown: true,
+	return notifier.Notify(types.Notification{
+		Event: types.NotifyEventContainerFailed,
+		Level: types.NotifyLevelFailure,
+		Title: title,
+		Text:  action,
+		Fields: map[string]string{
+			"stack":      stack,
+			"task":       taskArn,
+			"containers": strings.Join(containers, ", "),
+		},
+	})
+}
+
+//
+// Helpers
+//
+
+// failedContainers returns the essential containers of the task which stopped unsuccessfully.
+// Every container is treated as essential if the task definition can't be read.
+func failedContainers(log *log.Entry, event types.ECSEvent, containers types.ContainerManager) []string {
+	essential := make(map[string]bool)
+	names, err := containers.EssentialContainers(event.TaskDefinitionArn)
+	if err != nil {
+		log.Warnln("could not read task definition, treating all containers as essential:", err.Error())
+	}
+
+	for _, name := range names {
+		essential[name] = true
+	}
+
+	failed := make([]string, 0)
+	for _, c := range event.Containers {
+		if err == nil && !essential[c.Name] {
+			continue
+		}
+
+		if c.LastStatus != types.EcsStateStopped || (c.ExitCode != nil && *(c.ExitCode) == 0) {
+			continue
+		}
+
+		failed = append(failed, c.Name)
+	}
+
+	return failed
+}
+
+// owner returns the name of the stack owning the task's service or task definition.
+func owner(event types.ECSEvent, stacks types.StackManager, containers types.ContainerManager) (string, error) {
+	if strings.HasPrefix(event.Group, types.EcsServiceGroup) {
+		arn, err := containers.ServiceArn(event.ClusterArn, strings.TrimPrefix(event.Group, types.EcsServiceGroup))
+		if err != nil {
+			return "", err
+		}
+
+		name, err := stacks.Owner(arn)
+		if err != nil || name != "" {
+			return name, err
+		}
 	}
 
-	_, _, err := api.PostMessage(channelID, msg, params)
-	return err
+	return stacks.Owner(event.TaskDefinitionArn)
 }
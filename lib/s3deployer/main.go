@@ -38,11 +38,11 @@ func Handler(event events.CodePipelineEvent) error {
 
 	// AWS session
 	sess := session.Must(session.NewSession())
-	pipeline := pipeline.NewAWSPipelineManager(sess)
 
 	id := event.CodePipelineJob.ID
 	data := event.CodePipelineJob.Data
 	log := log.WithFields(log.Fields{"jobId": id})
+	pipeline := pipeline.NewAWSPipelineManager(log, sess)
 
 	// Get input artifacts
 	stackArtifact, buildArtifact, err := getArtifacts(sess, data)
@@ -2,27 +2,27 @@ package main
 
 import (
 	"fmt"
+	"os"
+	"strconv"
 
-	"github.com/opolis/build/secure"
+	"github.com/ngmiller/fabrik/alert"
+	"github.com/ngmiller/fabrik/notify"
+	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/types"
 
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/nlopes/slack"
 
 	log "github.com/sirupsen/logrus"
 )
 
-// TODO: these need to be configurable by the user in some fashion
-// Ultimately, I think it will boil down to decouple these lib/ functions
-// from the main serverless deploy spec, and allow them to be deployed separately,
-// where env variables and more specific IAM roles can be set
+// Log events are routed as 'log.event' notifications, see the notify package
+// for the sinks and routes, and the alert package for which events alert.
 const (
-	tokenKey  = "bot.slack.token"
-	channelID = "CCDAY0552"
-
-	templateLink  = "https://us-west-2.console.aws.amazon.com/cloudwatch/home?region=us-west-2#logEventViewer:group=%s;stream=%s"
-	templateEvent = "<!channel> Event from *%s* <%s|view on CloudWatch>"
+	templateLink   = "https://%s.console.aws.amazon.com/cloudwatch/home?region=%s#logEventViewer:group=%s;stream=%s"
+	templateEvent  = "Event from *%s*"
+	templateDigest = "%d events from *%s*"
 )
 
 func init() {
@@ -43,46 +43,137 @@ func Handler(event events.CloudwatchLogsEvent) error {
 	// AWS Session
 	sesh := session.Must(session.NewSession())
 
-	// Slack OAuth token
+	// notification routes
 	secureStore := secure.NewAWSSecureStore(sesh)
-	token, err := secureStore.Get(tokenKey)
+	notifier, err := notify.Load(secureStore)
 	if err != nil {
-		log.Errorln("could not fetch slack token:", err.Error())
+		log.Errorln("could not load notification config:", err.Error())
 		return nil
 	}
 
+	// alert rules, every event alerts without them
+	config, err := alert.Load(secureStore)
+	if err != nil {
+		log.Warnln("using default alert rules:", err.Error())
+		config = alert.Default()
+	}
+
+	// deduplication and rate limiting across invocations require a table
+	var throttle types.Throttle
+	if table := os.Getenv("ALERT_TABLE"); table != "" {
+		throttle = alert.NewAWSThrottle(sesh, table)
+	}
+
 	logs, err := event.AWSLogs.Parse()
 	if err != nil {
 		log.Errorln(err.Error())
 		return nil
 	}
 
+	messages := make([]string, 0, len(logs.LogEvents))
 	for _, logEvent := range logs.LogEvents {
-		if err := PostMessage(token, logs.LogGroup, logs.LogStream, logEvent.Message); err != nil {
-			log.Errorln("could not post message:", err.Error())
+		messages = append(messages, logEvent.Message)
+	}
+
+	log := log.WithFields(log.Fields{"group": logs.LogGroup, "stream": logs.LogStream})
+	if err := Process(log, notifier, throttle, config, logs.LogGroup, logs.LogStream, messages); err != nil {
+		log.Errorln("could not post message:", err.Error())
+	}
+
+	return nil
+}
+
+// Process evaluates a batch of log events from a stream against the alert rules, and sends
+// one notification for those which alert: the event itself, or a digest of a burst. Messages
+// which alerted recently are suppressed, and each stream's notifications are rate limited.
+func Process(log *log.Entry, notifier types.Notifier, throttle types.Throttle, config alert.Config, group, stream string, messages []string) error {
+	entries := make([]alert.Entry, 0, len(messages))
+	for _, message := range messages {
+		entries = append(entries, alert.Parse(message))
+	}
+
+	evaluated := config.Evaluate(entries)
+	if len(evaluated) == 0 {
+		log.Infoln("no alerting events - no action")
+		return nil
+	}
+
+	// check the rate limit before recording duplicates, so alerts dropped here
+	// are not suppressed for the whole dedup window once the limit lifts
+	if throttle != nil {
+		ok, err := throttle.Allow("rate#"+stream, config.RateLimit, config.RateWindow())
+		if err != nil {
+			log.Warnln("could not check rate limit:", err.Error())
+		} else if !ok {
+			log.Warnln("rate limit reached, dropping", len(evaluated), "alerts")
 			return nil
 		}
 	}
 
-	return nil
+	alerts := make([]alert.Alert, 0)
+	suppressed := 0
+
+	for _, a := range evaluated {
+		if throttle != nil {
+			ok, err := throttle.Allow("dedup#"+stream+"#"+a.Fingerprint, 1, config.DedupPeriod())
+			if err != nil {
+				log.Warnln("could not check for duplicates:", err.Error())
+			} else if !ok {
+				suppressed += a.Count
+				continue
+			}
+		}
+
+		alerts = append(alerts, a)
+	}
+
+	if len(alerts) == 0 {
+		log.Infoln("all alerting events suppressed", suppressed, "- no action")
+		return nil
+	}
+
+	return notifier.Notify(notification(group, stream, alerts, suppressed, config.DigestLines))
 }
 
-func PostMessage(token, group, stream, message string) error {
-	// slack session
-	api := slack.New(token)
+//
+// Helpers
+//
+
+func notification(group, stream string, alerts []alert.Alert, suppressed, lines int) types.Notification {
+	notification := types.Notification{
+		Event:  types.NotifyEventLog,
+		Level:  types.NotifyLevelWarning,
+		Url:    formatLink(group, stream),
+		Fields: map[string]string{"group": group},
+	}
+
+	total := 0
+	for _, a := range alerts {
+		total += a.Count
 
-	event := formatEvent(group, stream)
+		switch a.Entry.Level {
+		case "error", "fatal", "panic":
+			notification.Level = types.NotifyLevelFailure
+		}
+	}
+
+	if total == 1 {
+		notification.Title = fmt.Sprintf(templateEvent, stream)
+		notification.Text = alerts[0].Entry.Message
+		notification.Fields["rule"] = alerts[0].Rule
+	} else {
+		notification.Title = fmt.Sprintf(templateDigest, total, stream)
+		notification.Text = alert.Digest(alerts, lines)
+	}
 
-	attach := slack.Attachment{Text: message}
-	params := slack.PostMessageParameters{
-		Attachments: []slack.Attachment{attach},
-		Markdown:    true,
+	if suppressed > 0 {
+		notification.Fields["suppressed"] = strconv.Itoa(suppressed)
 	}
 
-	_, _, err := api.PostMessage(channelID, event, params)
-	return err
+	return notification
 }
 
-func formatEvent(group, stream string) string {
-	return fmt.Sprintf(templateEvent, stream, fmt.Sprintf(templateLink, group, stream))
+func formatLink(group, stream string) string {
+	region := os.Getenv("AWS_REGION")
+	return fmt.Sprintf(templateLink, region, region, group, stream)
 }
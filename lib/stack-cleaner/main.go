@@ -102,25 +102,25 @@ func Handler(event types.CloudFormationEvent) error {
 	return Response(event.ResponseURL, response)
 }
 
-func Process(log *log.Entry, stop <-chan struct{}, stack string, manager types.StackManager) <-chan error {
+func Process(log *log.Entry, stop <-chan struct{}, name string, manager types.StackManager) <-chan error {
 	result := make(chan error)
 	go func() {
-		exists, status, _ := manager.Status(stack)
+		exists, status, _ := manager.Status(name)
 		if !exists {
-			log.Infoln(fmt.Sprintf("stack %s not found, operation complete", stack))
+			log.Infoln(fmt.Sprintf("stack %s not found, operation complete", name))
 			result <- nil
 			return
 		}
 
-		if !statusInProgress(status) {
-			if err := manager.Delete(stack); err != nil {
+		if status.IsTerminal() {
+			if err := manager.Delete(name); err != nil {
 				log.Infoln("stack delete failed")
 				result <- err
 				return
 			}
 		}
 
-		for {
+		for polls := 0; ; polls++ {
 			select {
 			case <-stop:
 				log.Infoln("stack monitor received stop signal")
@@ -128,7 +128,7 @@ func Process(log *log.Entry, stop <-chan struct{}, stack string, manager types.S
 				return
 
 			default:
-				exists, status, _ := manager.Status(stack)
+				exists, status, _ := manager.Status(name)
 				if !exists {
 					log.Infoln("done!")
 					result <- nil
@@ -137,13 +137,13 @@ func Process(log *log.Entry, stop <-chan struct{}, stack string, manager types.S
 
 				log.Infoln("stack status", status)
 
-				if statusRollback(status) || statusFailed(status) {
+				if status.IsRollback() || status.IsFailed() {
 					result <- errors.New("stack rollback or failure")
 					return
 				}
 
-				// in progress, wait for 1 second
-				time.Sleep(time.Second)
+				// in progress, wait for a while longer each time
+				time.Sleep(stack.Backoff(polls))
 				continue
 			}
 		}
@@ -166,19 +166,3 @@ func Response(url string, response types.CloudFormationResponse) error {
 	_, err = http.DefaultClient.Do(request)
 	return err
 }
-
-func statusComplete(status string) bool {
-	return types.RegexCompleted.MatchString(status)
-}
-
-func statusInProgress(status string) bool {
-	return types.RegexInProgress.MatchString(status)
-}
-
-func statusRollback(status string) bool {
-	return types.RegexRollback.MatchString(status)
-}
-
-func statusFailed(status string) bool {
-	return types.RegexFailed.MatchString(status)
-}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/ngmiller/fabrik/history"
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	log "github.com/sirupsen/logrus"
+)
+
+const (
+	// Days of history summarized when not specified
+	DefaultDays = 30
+)
+
+func init() {
+	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
+}
+
+func main() {
+	lambda.Start(Handler)
+}
+
+// Handler reports delivery metrics for a repository's pipelines, read from the execution
+// history recorded by the notifier. i.e. GET /metrics?repo=owner/name&environment=production&days=30
+// Without an environment, every stage is reported.
+func Handler(request events.APIGatewayProxyRequest) (events.APIGatewayProxyResponse, error) {
+	repo := request.QueryStringParameters["repo"]
+	if repo == "" {
+		return response(http.StatusBadRequest, map[string]string{"error": "repo is required"}), nil
+	}
+
+	days := DefaultDays
+	if value, ok := request.QueryStringParameters["days"]; ok {
+		var err error
+		if days, err = strconv.Atoi(value); err != nil || days <= 0 {
+			return response(http.StatusBadRequest, map[string]string{"error": "days must be a positive integer"}), nil
+		}
+	}
+
+	environments := []string{
+		types.StageDevelopment,
+		types.StageStaging,
+		types.StagePreProduction,
+		types.StageProduction,
+	}
+
+	if environment := request.QueryStringParameters["environment"]; environment != "" {
+		environments = []string{environment}
+	}
+
+	sess := session.Must(session.NewSession())
+	store := history.NewAWSHistoryStore(sess, os.Getenv("HISTORY_TABLE"))
+
+	metrics, err := Process(store, repo, environments, time.Now().AddDate(0, 0, -days))
+	if err != nil {
+		log.Errorln("error reading history:", err.Error())
+		return response(http.StatusInternalServerError, map[string]string{"error": "could not read history"}), nil
+	}
+
+	return response(http.StatusOK, metrics), nil
+}
+
+// Process summarizes the executions of a repository's pipelines in each environment since
+// the given time.
+func Process(store types.HistoryStore, repo string, environments []string, since time.Time) ([]types.PipelineMetrics, error) {
+	metrics := make([]types.PipelineMetrics, 0, len(environments))
+	for _, environment := range environments {
+		executions, err := store.Executions(repo, environment, since)
+		if err != nil {
+			return nil, err
+		}
+
+		metrics = append(metrics, history.Summarize(repo, environment, executions))
+	}
+
+	return metrics, nil
+}
+
+//
+// Helpers
+//
+
+func response(status int, body interface{}) events.APIGatewayProxyResponse {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return events.APIGatewayProxyResponse{StatusCode: http.StatusInternalServerError}
+	}
+
+	return events.APIGatewayProxyResponse{
+		StatusCode: status,
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(payload),
+	}
+}
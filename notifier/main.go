@@ -4,10 +4,17 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
+	"time"
 
+	"github.com/ngmiller/fabrik/approval"
+	"github.com/ngmiller/fabrik/history"
+	"github.com/ngmiller/fabrik/notify"
 	"github.com/ngmiller/fabrik/pipeline"
 	"github.com/ngmiller/fabrik/repo"
 	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/stack"
+	"github.com/ngmiller/fabrik/target"
 	"github.com/ngmiller/fabrik/types"
 
 	"github.com/aws/aws-lambda-go/events"
@@ -16,6 +23,17 @@ import (
 	log "github.com/sirupsen/logrus"
 )
 
+const (
+	// Build log lines included in failed check runs
+	LogExcerptLines = 30
+
+	// CodeBuild reads build commands from the repository's buildspec
+	BuildspecPath = "buildspec.yml"
+)
+
+// Assumed role sessions of the deployment targets, kept while the function is warm
+var targetSessions *target.Sessions
+
 func init() {
 	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
 }
@@ -36,7 +54,7 @@ func Handler(event events.CloudWatchEvent) error {
 	// AWS session
 	sess := session.Must(session.NewSession())
 
-	// Pull the pipeline event detail
+	// Pull the pipeline event detail, the pipeline is common to stage and action events
 	var detail types.PipelineStageDetail
 	if err := json.Unmarshal(event.Detail, &detail); err != nil {
 		log.Errorln("json.Unmarshal:", err.Error())
@@ -51,48 +69,490 @@ func Handler(event events.CloudWatchEvent) error {
 		return nil
 	}
 
-	// Create the pipeline manager and repository
-	manager := pipeline.NewAWSPipelineManager(sess)
-	owner, repoName, err := manager.GetRepoInfo(detail.Pipeline)
+	// pipelines of deployment targets are read through the target's role, as their
+	// events are forwarded to this account
+	targets, err := target.Load(secureStore)
+	if err != nil && !secure.NotFound(err) {
+		log.Errorln("error loading deployment targets:", err.Error())
+		return nil
+	}
+
+	if targetSessions == nil {
+		targetSessions = target.NewSessions(sess, os.Getenv("ARTIFACT_STORE"))
+	}
+
+	pipelineSession, err := targetSessions.Resolve(targets, event.AccountID, event.Region)
 	if err != nil {
-		log.Errorln("error getting repo info:", err.Error())
+		log.Errorln("error preparing deployment target:", err.Error())
 		return nil
 	}
 
-	log := log.WithFields(log.Fields{"pipeline": detail.Pipeline})
-	repo := repo.NewGitHubRepository(log, owner, repoName, token)
+	// check runs identify their pipeline by account and region, for re-runs
+	pipelineId := target.PipelineId(event.AccountID, event.Region, detail.Pipeline)
 
-	if err := Process(detail, manager, repo); err != nil {
-		log.Errorln("error processing:", err.Error())
+	// Create the pipeline manager, and find each source repository of the execution
+	manager := pipeline.NewAWSPipelineManager(log.WithField("pipeline", detail.Pipeline), pipelineSession)
+	sources, err := manager.GetSources(detail.ExecutionId, detail.Pipeline)
+	if err != nil {
+		log.Errorln("error getting pipeline sources:", err.Error())
 		return nil
 	}
 
+	// execution history, recorded alongside the repository statuses
+	store := history.NewAWSHistoryStore(sess, os.Getenv("HISTORY_TABLE"))
+
+	notifier, err := notify.Load(secureStore)
+	if err != nil {
+		log.Warnln("notifications disabled:", err.Error())
+	}
+
+	var process func(log *log.Entry, source types.PipelineSource, repo types.Repository) error
+
+	switch event.DetailType {
+	case types.PipelineDetailExecution:
+		var execution types.PipelineExecutionDetail
+		if err := json.Unmarshal(event.Detail, &execution); err != nil {
+			log.Errorln("json.Unmarshal:", err.Error())
+			return nil
+		}
+
+		stackManager := stack.NewAWSStackManager(log.WithFields(log.Fields{"pipeline": detail.Pipeline}), pipelineSession)
+		environment := pipelineEnvironment(log.WithFields(log.Fields{"pipeline": detail.Pipeline}), detail.Pipeline, stackManager)
+
+		process = func(log *log.Entry, source types.PipelineSource, repo types.Repository) error {
+			if err := RecordExecution(execution, event.Time, environment, source, store); err != nil {
+				log.Warnln("could not record execution:", err.Error())
+			}
+
+			if err := NotifyExecution(execution, environment, source, notifier); err != nil {
+				log.Warnln("could not send notification:", err.Error())
+			}
+
+			return ProcessExecution(log, execution, pipelineId, environment, source, stackManager, repo)
+		}
+
+	case types.PipelineDetailAction:
+		var action types.PipelineActionDetail
+		if err := json.Unmarshal(event.Detail, &action); err != nil {
+			log.Errorln("json.Unmarshal:", err.Error())
+			return nil
+		}
+
+		// approvals are requested once per execution, rather than per source
+		if action.Type.Category == types.PipelineCategoryApproval && action.State == types.PipelineStateStarted {
+			log := log.WithFields(log.Fields{"pipeline": detail.Pipeline, "action": action.Action})
+			if err := RequestApproval(log, action, event.AccountID, event.Region, sources, manager, secureStore); err != nil {
+				log.Errorln("error requesting approval:", err.Error())
+			}
+		}
+
+		process = func(log *log.Entry, source types.PipelineSource, repo types.Repository) error {
+			return ProcessAction(log, action, pipelineId, source, manager, repo)
+		}
+
+	default:
+		process = func(log *log.Entry, source types.PipelineSource, repo types.Repository) error {
+			if err := RecordStage(detail, event.Time, source, store); err != nil {
+				log.Warnln("could not record stage:", err.Error())
+			}
+
+			return Process(detail, pipelineId, source, repo)
+		}
+	}
+
+	// report to every source repository
+	for _, source := range sources {
+		log := log.WithFields(log.Fields{
+			"pipeline": detail.Pipeline,
+			"repo":     source.Repo,
+			"source":   source.Action,
+		})
+
+		// API token, which differs from the pipeline's OAuth token when using checks
+		apiToken, err := repo.Token(secureStore, token, source.Owner, source.Repo)
+		if err != nil {
+			log.Errorln("error getting api token:", err.Error())
+			continue
+		}
+
+		repo := repo.NewGitHubRepository(log, source.Owner, source.Repo, apiToken)
+		if err := process(log, source, repo); err != nil {
+			log.Errorln("error processing:", err.Error())
+		}
+	}
+
 	return nil
 }
 
 // Process reads the pipeline event detail and writes a status back to the
 // source repository.
-func Process(detail types.PipelineStageDetail, manager types.PipelineManager, repo types.Repository) error {
-	// get current revision
-	revision, err := manager.GetRevision(detail.ExecutionId, detail.Pipeline)
-	if err != nil {
-		return err
-	}
+func Process(detail types.PipelineStageDetail, pipelineId string, source types.PipelineSource, repo types.Repository) error {
+	revision := source.Revision
 
 	// update status
+	status := types.GitHubStatus{
+		State:       mapState(detail.State),
+		TargetUrl:   statusUrl(detail.Pipeline),
+		Description: stateDescription(detail.State),
+		Context:     "pipeline/" + detail.Stage,
+	}
+
+	return report(repo, revision, status, pipelineId, nil)
+}
+
+// ProcessAction reads the pipeline action event detail and writes a status back to the
+// source repository, describing the action's duration and failure, and linking to its log.
+func ProcessAction(log *log.Entry, detail types.PipelineActionDetail, pipelineId string, source types.PipelineSource, manager types.PipelineManager, r types.Repository) error {
+	revision := source.Revision
+
 	status := types.GitHubStatus{
 		State:     mapState(detail.State),
 		TargetUrl: statusUrl(detail.Pipeline),
-		Context:   "pipeline/" + detail.Stage,
+		Context:   fmt.Sprintf("pipeline/%s/%s", detail.Stage, detail.Action),
+	}
+
+	// execution details are best effort, post the status regardless
+	execution, err := manager.GetActionExecution(detail.ExecutionId, detail.Pipeline, detail.Stage, detail.Action)
+	if err != nil {
+		log.Warnln("could not get action execution:", err.Error())
+		return report(r, revision, status, pipelineId, nil)
+	}
+
+	status.Description = types.StatusDescription(actionDescription(detail.State, execution))
+
+	if execution.LogUrl != "" {
+		status.TargetUrl = execution.LogUrl
+	} else if execution.ExternalUrl != "" {
+		status.TargetUrl = execution.ExternalUrl
+	}
+
+	var output *types.GitHubCheckOutput
+	if repo.ChecksEnabled() {
+		output = actionOutput(log, detail, execution, manager)
+	}
+
+	return report(r, revision, status, pipelineId, output)
+}
+
+// ProcessExecution reads the pipeline execution event detail and updates the status of the
+// deployment created for the pipeline's stack. Successful deployments link to the environment
+// URL found in the stack's outputs. Tags are deployed from the head of the default branch, so
+// release executions of any other commit than the tagged one are reported as failed.
+func ProcessExecution(log *log.Entry, detail types.PipelineExecutionDetail, pipelineId, environment string, source types.PipelineSource, stacks types.StackManager, repo types.Repository) error {
+	// pipelines are named after their stack
+	deployments, err := repo.Deployments(source.Revision, "")
+	if err != nil {
+		return err
+	}
+
+	for _, deployment := range deployments {
+		if deployment.Payload.Stack != detail.Pipeline {
+			continue
+		}
+
+		status := types.GitHubDeploymentStatus{
+			State:       deploymentState(detail.State),
+			LogUrl:      statusUrl(detail.Pipeline),
+			Description: stateDescription(detail.State),
+		}
+
+		if status.State == types.DeploymentStateSuccess && deployment.Payload.UrlOutput != "" {
+			outputs, err := stacks.Outputs(detail.Pipeline)
+			if err != nil {
+				log.Warnln("could not get stack outputs:", err.Error())
+			}
+
+			status.EnvironmentUrl = outputs[deployment.Payload.UrlOutput]
+		}
+
+		return repo.DeploymentStatus(deployment.Id, status)
+	}
+
+	// the builder deploys the tagged commit, any other revision was pushed after the tag
+	release := environment == types.StageProduction || environment == types.StagePreProduction
+	if release && detail.State == types.PipelineStateStarted {
+		return report(repo, source.Revision, types.GitHubStatus{
+			State:       types.GitStateFailure,
+			TargetUrl:   statusUrl(detail.Pipeline),
+			Description: fmt.Sprintf("executed revision %s is not a tagged commit", shortHash(source.Revision)),
+			Context:     "pipeline/revision",
+		}, pipelineId, nil)
+	}
+
+	log.Infoln("no deployment for pipeline - no action")
+	return nil
+}
+
+// RequestApproval posts an interactive approval request for a manual approval action to the
+// configured Slack channel and webhook. Results are handled by the approver.
+func RequestApproval(log *log.Entry, detail types.PipelineActionDetail, account, region string, sources []types.PipelineSource, manager types.PipelineManager, store types.SecureStore) error {
+	channel := os.Getenv("APPROVAL_CHANNEL")
+	webhook := os.Getenv("APPROVAL_WEBHOOK")
+
+	if channel == "" && webhook == "" {
+		log.Infoln("no approval channel or webhook configured - no action")
+		return nil
+	}
+
+	request, err := manager.GetApproval(detail.ExecutionId, detail.Pipeline, detail.Stage, detail.Action)
+	if err != nil {
+		return err
+	}
+
+	// results are recorded through the role of the pipeline's target, if any
+	request.Account, request.Region = account, region
+	request.Sources = sources
+
+	if channel != "" {
+		token, err := store.Get(types.KeySlackToken)
+		if err != nil {
+			return err
+		}
+
+		if err := approval.PostSlack(token, channel, request); err != nil {
+			return err
+		}
 	}
 
-	return repo.Status(revision, status)
+	if webhook != "" {
+		secret, err := store.Get(types.KeyWebhookSecret)
+		if err != nil {
+			return err
+		}
+
+		if err := approval.PostWebhook(webhook, secret, os.Getenv("APPROVAL_CALLBACK"), request); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// NotifyExecution sends a notification for a finished pipeline execution.
+func NotifyExecution(detail types.PipelineExecutionDetail, environment string, source types.PipelineSource, notifier types.Notifier) error {
+	if !isFinished(detail.State) {
+		return nil
+	}
+
+	notification := types.Notification{
+		Event:       types.NotifyEventPipelineCanceled,
+		Level:       types.NotifyLevelWarning,
+		Repo:        source.Owner + "/" + source.Repo,
+		Environment: environment,
+		Title:       fmt.Sprintf("Pipeline %s: %s", detail.Pipeline, stateDescription(detail.State)),
+		Text:        strings.SplitN(source.Summary, "\n", 2)[0],
+		Url:         statusUrl(detail.Pipeline),
+		Fields: map[string]string{
+			"ref":    source.Branch,
+			"commit": shortHash(source.Revision),
+		},
+	}
+
+	switch detail.State {
+	case types.PipelineStateSucceeded:
+		notification.Event = types.NotifyEventPipelineSucceeded
+		notification.Level = types.NotifyLevelSuccess
+		notification.Title = fmt.Sprintf("Pipeline %s succeeded", detail.Pipeline)
+	case types.PipelineStateFailed:
+		notification.Event = types.NotifyEventPipelineFailed
+		notification.Level = types.NotifyLevelFailure
+		notification.Title = fmt.Sprintf("Pipeline %s failed", detail.Pipeline)
+	}
+
+	return notifier.Notify(notification)
+}
+
+// RecordExecution records a change in the state of a pipeline execution in the execution
+// history of the source repository.
+func RecordExecution(detail types.PipelineExecutionDetail, at time.Time, environment string, source types.PipelineSource, store types.HistoryStore) error {
+	execution := types.PipelineExecution{
+		Id:          detail.ExecutionId,
+		Pipeline:    detail.Pipeline,
+		Repo:        source.Owner + "/" + source.Repo,
+		Ref:         source.Branch,
+		Commit:      source.Revision,
+		Environment: environment,
+		State:       detail.State,
+		Committed:   source.Committed,
+	}
+
+	if detail.State == types.PipelineStateStarted {
+		execution.Started = &at
+	} else if isFinished(detail.State) {
+		execution.Finished = &at
+	}
+
+	return store.Record(execution)
+}
+
+// RecordStage records a change in the state of a pipeline stage in the execution
+// history of the source repository.
+func RecordStage(detail types.PipelineStageDetail, at time.Time, source types.PipelineSource, store types.HistoryStore) error {
+	stage := types.StageExecution{
+		Name:  detail.Stage,
+		State: detail.State,
+	}
+
+	if detail.State == types.PipelineStateStarted {
+		stage.Started = &at
+	} else if isFinished(detail.State) {
+		stage.Finished = &at
+	}
+
+	return store.RecordStage(detail.ExecutionId, source.Owner+"/"+source.Repo, stage)
 }
 
 //
 // Helpers
 //
 
+// pipelineEnvironment reads the stage a pipeline deploys from its stack's parameters.
+func pipelineEnvironment(log *log.Entry, pipeline string, stacks types.StackManager) string {
+	parameters, err := stacks.Parameters(pipeline)
+	if err != nil {
+		log.Warnln("could not get stack parameters:", err.Error())
+		return ""
+	}
+
+	for _, parameter := range parameters {
+		if parameter.ParameterKey == types.ParameterStage {
+			return parameter.ParameterValue
+		}
+	}
+
+	return ""
+}
+
+// isFinished reports whether a pipeline state is final.
+func isFinished(state string) bool {
+	switch state {
+	case types.PipelineStateStarted, types.PipelineStateResumed, types.PipelineStateStopping:
+		return false
+	}
+
+	return true
+}
+
+func deploymentState(state string) string {
+	switch state {
+	case types.PipelineStateStarted, types.PipelineStateResumed, types.PipelineStateStopping:
+		return types.DeploymentStateInProgress
+	case types.PipelineStateSucceeded:
+		return types.DeploymentStateSuccess
+	case types.PipelineStateFailed:
+		return types.DeploymentStateFailure
+	case types.PipelineStateSuperseded:
+		// a newer execution carries on with the deployment
+		return types.DeploymentStateInactive
+	}
+
+	return types.DeploymentStateError
+}
+
+// report posts a commit status, or a check run when checks are enabled. Failed pipeline
+// check runs offer a re-run action, handled by the builder, which finds the pipeline by
+// the id the run carries.
+func report(r types.Repository, sha string, status types.GitHubStatus, pipelineId string, output *types.GitHubCheckOutput) error {
+	if !repo.ChecksEnabled() {
+		return r.Status(sha, status)
+	}
+
+	run := status.CheckRun()
+	run.ExternalId = pipelineId
+
+	if output != nil {
+		run.Output = output
+	}
+
+	if status.State != types.GitStatePending && status.State != types.GitStateSuccess {
+		run.Actions = []types.GitHubCheckAction{
+			types.GitHubCheckAction{
+				Label:       "Re-run",
+				Description: "Start a new pipeline execution",
+				Identifier:  types.CheckActionRerun,
+			},
+		}
+	}
+
+	return r.Check(sha, run)
+}
+
+// actionOutput reports an action execution for a check run, with an excerpt
+// of the build log for failed builds.
+func actionOutput(log *log.Entry, detail types.PipelineActionDetail, execution types.ActionExecution, manager types.PipelineManager) *types.GitHubCheckOutput {
+	description := actionDescription(detail.State, execution)
+	output := &types.GitHubCheckOutput{
+		Title:   types.StatusDescription(description),
+		Summary: fmt.Sprintf("`%s` in stage `%s`: %s", detail.Action, detail.Stage, description),
+	}
+
+	if execution.LogUrl != "" {
+		output.Summary += fmt.Sprintf("\n\n[View full build log](%s)", execution.LogUrl)
+	}
+
+	if detail.State != types.PipelineStateFailed || execution.LogStream == "" {
+		return output
+	}
+
+	lines, err := manager.GetBuildLog(execution, LogExcerptLines)
+	if err != nil {
+		log.Warnln("could not get build log:", err.Error())
+		return output
+	}
+
+	output.Text = fmt.Sprintf("Last %d lines of the build log:\n\n```\n%s\n```\n",
+		len(lines), strings.Join(lines, "\n"))
+
+	if execution.ErrorMessage != "" {
+		output.Annotations = []types.GitHubCheckAnnotation{
+			types.GitHubCheckAnnotation{
+				Path:            BuildspecPath,
+				StartLine:       1,
+				EndLine:         1,
+				AnnotationLevel: types.CheckAnnotationFailure,
+				Title:           detail.Action,
+				Message:         execution.ErrorMessage,
+			},
+		}
+	}
+
+	return output
+}
+
+// actionDescription summarizes an action execution, i.e. 'Failed after 1m3s: BUILD: exit status 1'
+func actionDescription(state string, execution types.ActionExecution) string {
+	description := "Started"
+	if state == types.PipelineStateSucceeded {
+		description = "Succeeded"
+	} else if state == types.PipelineStateFailed {
+		description = "Failed"
+	} else if state != types.PipelineStateStarted {
+		description = stateDescription(state)
+	}
+
+	if execution.Started != nil && state != types.PipelineStateStarted {
+		finished := time.Now()
+		if execution.Finished != nil {
+			finished = *(execution.Finished)
+		}
+
+		preposition := " in "
+		if state != types.PipelineStateSucceeded {
+			preposition = " after "
+		}
+
+		description += preposition + finished.Sub(*(execution.Started)).Round(time.Second).String()
+	}
+
+	if state != types.PipelineStateSucceeded && execution.ErrorMessage != "" {
+		description += ": " + execution.ErrorMessage
+	} else if execution.Summary != "" {
+		description += ": " + execution.Summary
+	}
+
+	return description
+}
+
 func statusUrl(pipeline string) string {
 	return fmt.Sprintf(
 		"https://%s.console.aws.amazon.com/codepipeline/home#/view/%s",
@@ -101,16 +561,44 @@ func statusUrl(pipeline string) string {
 	)
 }
 
+func shortHash(hash string) string {
+	if len(hash) < 6 {
+		return hash
+	}
+
+	return hash[:6]
+}
+
+// mapState maps a pipeline, stage or action state onto a commit status state. Executions
+// which never finished (canceled, superseded, stopped or abandoned) are reported as errors,
+// which check runs conclude as neutral, rather than as failures.
 func mapState(state string) string {
-	if state == types.PipelineStateStarted {
+	switch state {
+	case types.PipelineStateStarted, types.PipelineStateResumed, types.PipelineStateStopping:
 		return types.GitStatePending
+	case types.PipelineStateSucceeded:
+		return types.GitStateSuccess
+	case types.PipelineStateFailed:
+		return types.GitStateFailure
+	}
 
-	} else if state == types.PipelineStateResumed {
-		return types.GitStatePending
+	return types.GitStateError
+}
 
-	} else if state == types.PipelineStateSucceeded {
-		return types.GitStateSuccess
+// stateDescription explains the states which don't speak for themselves.
+func stateDescription(state string) string {
+	switch state {
+	case types.PipelineStateCanceled:
+		return "Canceled"
+	case types.PipelineStateSuperseded:
+		return "Superseded by a newer pipeline execution"
+	case types.PipelineStateStopping:
+		return "Stopping"
+	case types.PipelineStateStopped:
+		return "Stopped"
+	case types.PipelineStateAbandoned:
+		return "Abandoned"
 	}
 
-	return types.GitStateFailure
+	return ""
 }
@@ -0,0 +1,94 @@
+package notify
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+const (
+	// SMTP submission port, used when none is configured
+	DefaultSMTPPort = 587
+)
+
+// EmailNotifier sends notifications as plain text email over SMTP. Servers offering
+// STARTTLS are used encrypted, and credentials are only sent when a username is set.
+type EmailNotifier struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+	to       []string
+}
+
+func NewEmailNotifier(host string, port int, username, password, from string, to []string) *EmailNotifier {
+	if port == 0 {
+		port = DefaultSMTPPort
+	}
+
+	return &EmailNotifier{
+		host:     host,
+		port:     port,
+		username: username,
+		password: password,
+		from:     from,
+		to:       to,
+	}
+}
+
+func (n *EmailNotifier) Notify(notification types.Notification) error {
+	var auth smtp.Auth
+	if n.username != "" {
+		auth = smtp.PlainAuth("", n.username, n.password, n.host)
+	}
+
+	address := net.JoinHostPort(n.host, strconv.Itoa(n.port))
+	return smtp.SendMail(address, auth, n.from, n.to, n.message(notification))
+}
+
+//
+// Helpers
+//
+
+func (n *EmailNotifier) message(notification types.Notification) []byte {
+	var body bytes.Buffer
+
+	// headers can't span lines, and non-ASCII subjects must be encoded
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(notification.Title)
+	subject = mime.QEncoding.Encode("utf-8", "[fabrik] "+subject)
+
+	fmt.Fprintf(&body, "From: %s\r\n", n.from)
+	fmt.Fprintf(&body, "To: %s\r\n", strings.Join(n.to, ", "))
+	fmt.Fprintf(&body, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&body, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&body, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+
+	if notification.Text != "" {
+		fmt.Fprintf(&body, "%s\r\n\r\n", notification.Text)
+	}
+
+	keys := make([]string, 0, len(notification.Fields))
+	for key := range notification.Fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&body, "%s: %s\r\n", key, notification.Fields[key])
+	}
+
+	if notification.Url != "" {
+		fmt.Fprintf(&body, "\r\n%s\r\n", notification.Url)
+	}
+
+	return body.Bytes()
+}
@@ -0,0 +1,306 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"text/template"
+
+	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/types"
+)
+
+const (
+	SinkSlack   = "slack"
+	SinkTeams   = "teams"
+	SinkWebhook = "webhook"
+	SinkEmail   = "email"
+
+	// Log events and container failures were sent to this Slack channel, with the token
+	// kept under this key, before sinks and routes were configurable
+	DefaultSlackChannel  = "CCDAY0552"
+	DefaultSlackTokenKey = "bot.slack.token"
+)
+
+// Config defines the notification sinks, which events are routed to them, and how
+// messages are rendered. It's stored as JSON in the 'fabrik.notify.config' parameter.
+//
+//	{
+//	    "sinks": {"ops": {"type": "slack", "channel": "C0123", "secret_key": "bot.slack.token"}},
+//	    "routes": [{"repos": ["owner/*"], "environments": ["production"], "events": ["pipeline.*"], "sinks": ["ops"]}],
+//	    "templates": {"pipeline.failed": {"title": ":fire: {{.Repo}} failed in {{.Environment}}"}}
+//	}
+type Config struct {
+	Sinks     map[string]SinkConfig `json:"sinks"`
+	Routes    []Route               `json:"routes"`
+	Templates map[string]Template   `json:"templates"`
+}
+
+// SinkConfig configures a single destination. Secrets (the Slack token, webhook signing
+// secret or SMTP password) are read from the secure store by key, never kept in the config.
+type SinkConfig struct {
+	Type      string `json:"type"`
+	SecretKey string `json:"secret_key,omitempty"`
+
+	// slack
+	Channel string `json:"channel,omitempty"`
+	Mention string `json:"mention,omitempty"`
+
+	// teams, webhook
+	Url string `json:"url,omitempty"`
+
+	// email
+	Host     string   `json:"host,omitempty"`
+	Port     int      `json:"port,omitempty"`
+	Username string   `json:"username,omitempty"`
+	From     string   `json:"from,omitempty"`
+	To       []string `json:"to,omitempty"`
+}
+
+// Route sends matching notifications to sinks. Repos, environments and events are glob
+// patterns, i.e. 'owner/*' or 'pipeline.*', and an empty list matches everything.
+type Route struct {
+	Repos        []string `json:"repos"`
+	Environments []string `json:"environments"`
+	Events       []string `json:"events"`
+	Sinks        []string `json:"sinks"`
+}
+
+// Template overrides the title and text of an event's notifications. Templates are
+// rendered with the notification, i.e. '{{.Repo}}', '{{.Environment}}', '{{.Text}}'.
+type Template struct {
+	Title string `json:"title"`
+	Text  string `json:"text"`
+}
+
+// Router delivers notifications to every sink with a matching route.
+type Router struct {
+	sinks     map[string]types.Notifier
+	routes    []Route
+	templates map[string]*template.Template
+}
+
+// Load reads the notification config from the secure store, or uses the Default config if
+// none is stored. Load always returns a usable router; if the config can't be read, the
+// router has no routes and the error is returned.
+func Load(store types.SecureStore) (*Router, error) {
+	empty := &Router{}
+
+	raw, err := store.Get(types.KeyNotifyConfig)
+	if secure.NotFound(err) {
+		router, err := New(Default(), store)
+		if err != nil {
+			return empty, fmt.Errorf("default notification config: %s", err.Error())
+		}
+
+		return router, nil
+	} else if err != nil {
+		return empty, err
+	}
+
+	var config Config
+	if err := json.Unmarshal([]byte(raw), &config); err != nil {
+		return empty, fmt.Errorf("%s: %s", types.KeyNotifyConfig, err.Error())
+	}
+
+	router, err := New(config, store)
+	if err != nil {
+		return empty, fmt.Errorf("%s: %s", types.KeyNotifyConfig, err.Error())
+	}
+
+	return router, nil
+}
+
+// Default is the config used until one is stored, which sends log events and container
+// failures to the Slack channel they were sent to before routes were configurable.
+func Default() Config {
+	return Config{
+		Sinks: map[string]SinkConfig{
+			"default": SinkConfig{Type: SinkSlack, Channel: DefaultSlackChannel, SecretKey: DefaultSlackTokenKey},
+		},
+		Routes: []Route{
+			Route{Events: []string{types.NotifyEventLog, types.NotifyEventContainerFailed}, Sinks: []string{"default"}},
+		},
+	}
+}
+
+// New creates a router from a config, resolving sink secrets from the secure store.
+func New(config Config, store types.SecureStore) (*Router, error) {
+	router := &Router{
+		sinks:     make(map[string]types.Notifier),
+		routes:    config.Routes,
+		templates: make(map[string]*template.Template),
+	}
+
+	for name, sink := range config.Sinks {
+		secret := ""
+		if sink.SecretKey != "" {
+			var err error
+			if secret, err = store.Get(sink.SecretKey); err != nil {
+				return nil, fmt.Errorf("sink %s: %s", name, err.Error())
+			}
+		}
+
+		notifier, err := newSink(sink, secret)
+		if err != nil {
+			return nil, fmt.Errorf("sink %s: %s", name, err.Error())
+		}
+
+		router.sinks[name] = notifier
+	}
+
+	for i, route := range config.Routes {
+		for _, name := range route.Sinks {
+			if _, ok := router.sinks[name]; !ok {
+				return nil, fmt.Errorf("routes[%d]: unknown sink %s", i, name)
+			}
+		}
+	}
+
+	for event, t := range config.Templates {
+		// empty templates leave the field as is
+		title, text := t.Title, t.Text
+		if title == "" {
+			title = "{{.Title}}"
+		}
+
+		if text == "" {
+			text = "{{.Text}}"
+		}
+
+		parsed, err := template.New(event).Parse(`{{define "title"}}` + title + `{{end}}{{define "text"}}` + text + `{{end}}`)
+		if err != nil {
+			return nil, fmt.Errorf("templates.%s: %s", event, err.Error())
+		}
+
+		router.templates[event] = parsed
+	}
+
+	return router, nil
+}
+
+// Notify renders a notification and delivers it to each matching sink, once. Every sink
+// is attempted, failures are returned together.
+func (r *Router) Notify(notification types.Notification) error {
+	names := r.match(notification)
+	if len(names) == 0 {
+		return nil
+	}
+
+	notification, err := r.render(notification)
+	if err != nil {
+		return err
+	}
+
+	failures := make([]string, 0)
+	for _, name := range names {
+		if err := r.sinks[name].Notify(notification); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+	}
+
+	if len(failures) > 0 {
+		return errors.New(strings.Join(failures, "; "))
+	}
+
+	return nil
+}
+
+//
+// Helpers
+//
+
+func newSink(config SinkConfig, secret string) (types.Notifier, error) {
+	switch config.Type {
+	case SinkSlack:
+		if config.Channel == "" || secret == "" {
+			return nil, errors.New("slack sinks require a channel and a secret_key for the token")
+		}
+
+		return NewSlackNotifier(secret, config.Channel, config.Mention), nil
+
+	case SinkTeams:
+		if config.Url == "" {
+			return nil, errors.New("teams sinks require a url")
+		}
+
+		return NewTeamsNotifier(config.Url), nil
+
+	case SinkWebhook:
+		if config.Url == "" {
+			return nil, errors.New("webhook sinks require a url")
+		}
+
+		return NewWebhookNotifier(config.Url, secret), nil
+
+	case SinkEmail:
+		if config.Host == "" || config.From == "" || len(config.To) == 0 {
+			return nil, errors.New("email sinks require a host, from and to")
+		}
+
+		return NewEmailNotifier(config.Host, config.Port, config.Username, secret, config.From, config.To), nil
+	}
+
+	return nil, fmt.Errorf("unknown sink type %q", config.Type)
+}
+
+// match returns the names of sinks routed to by the notification, sorted.
+func (r *Router) match(notification types.Notification) []string {
+	matched := make(map[string]bool)
+	for _, route := range r.routes {
+		if matchAny(route.Repos, notification.Repo) &&
+			matchAny(route.Environments, notification.Environment) &&
+			matchAny(route.Events, notification.Event) {
+			for _, name := range route.Sinks {
+				matched[name] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(matched))
+	for name := range matched {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+	return names
+}
+
+func (r *Router) render(notification types.Notification) (types.Notification, error) {
+	t, ok := r.templates[notification.Event]
+	if !ok {
+		return notification, nil
+	}
+
+	var title, text bytes.Buffer
+	if err := t.ExecuteTemplate(&title, "title", notification); err != nil {
+		return notification, err
+	}
+
+	if err := t.ExecuteTemplate(&text, "text", notification); err != nil {
+		return notification, err
+	}
+
+	notification.Title = title.String()
+	notification.Text = text.String()
+
+	return notification, nil
+}
+
+func matchAny(patterns []string, value string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, value); ok {
+			return true
+		}
+	}
+
+	return false
+}
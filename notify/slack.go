@@ -0,0 +1,83 @@
+package notify
+
+import (
+	"sort"
+
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/nlopes/slack"
+)
+
+// SlackNotifier posts notifications to a Slack channel.
+type SlackNotifier struct {
+	client  *slack.Client
+	channel string
+	mention string
+}
+
+// NewSlackNotifier creates a Slack sink. Messages are prefixed with the mention,
+// i.e. '<!channel>', when given.
+func NewSlackNotifier(token, channel, mention string) *SlackNotifier {
+	return &SlackNotifier{
+		client:  slack.New(token),
+		channel: channel,
+		mention: mention,
+	}
+}
+
+func (n *SlackNotifier) Notify(notification types.Notification) error {
+	text := notification.Title
+	if n.mention != "" {
+		text = n.mention + " " + text
+	}
+
+	attachment := slack.Attachment{
+		Fallback:   notification.Title,
+		Color:      slackColor(notification.Level),
+		Text:       notification.Text,
+		TitleLink:  notification.Url,
+		MarkdownIn: []string{"text"},
+	}
+
+	if notification.Url != "" {
+		attachment.Title = "View details"
+	}
+
+	keys := make([]string, 0, len(notification.Fields))
+	for key := range notification.Fields {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	for _, key := range keys {
+		attachment.Fields = append(attachment.Fields, slack.AttachmentField{
+			Title: key,
+			Value: notification.Fields[key],
+			Short: true,
+		})
+	}
+
+	_, _, err := n.client.PostMessage(n.channel, text, slack.PostMessageParameters{
+		Attachments: []slack.Attachment{attachment},
+		Markdown:    true,
+	})
+
+	return err
+}
+
+//
+// Helpers
+//
+
+func slackColor(level string) string {
+	switch level {
+	case types.NotifyLevelSuccess:
+		return "good"
+	case types.NotifyLevelWarning:
+		return "warning"
+	case types.NotifyLevelFailure:
+		return "danger"
+	}
+
+	return ""
+}
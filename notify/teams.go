@@ -0,0 +1,104 @@
+package notify
+
+import (
+	"sort"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+// TeamsNotifier posts notifications to a Microsoft Teams channel's incoming webhook,
+// as message cards.
+type TeamsNotifier struct {
+	url string
+}
+
+type teamsCard struct {
+	Type       string         `json:"@type"`
+	Context    string         `json:"@context"`
+	Summary    string         `json:"summary"`
+	ThemeColor string         `json:"themeColor,omitempty"`
+	Title      string         `json:"title"`
+	Text       string         `json:"text,omitempty"`
+	Sections   []teamsSection `json:"sections,omitempty"`
+	Actions    []teamsAction  `json:"potentialAction,omitempty"`
+}
+
+type teamsSection struct {
+	Facts []teamsFact `json:"facts"`
+}
+
+type teamsFact struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type teamsAction struct {
+	Type    string        `json:"@type"`
+	Name    string        `json:"name"`
+	Targets []teamsTarget `json:"targets"`
+}
+
+type teamsTarget struct {
+	OS  string `json:"os"`
+	Uri string `json:"uri"`
+}
+
+func NewTeamsNotifier(url string) *TeamsNotifier {
+	return &TeamsNotifier{url: url}
+}
+
+func (n *TeamsNotifier) Notify(notification types.Notification) error {
+	card := teamsCard{
+		Type:       "MessageCard",
+		Context:    "https://schema.org/extensions",
+		Summary:    notification.Title,
+		ThemeColor: teamsColor(notification.Level),
+		Title:      notification.Title,
+		Text:       notification.Text,
+	}
+
+	if len(notification.Fields) > 0 {
+		keys := make([]string, 0, len(notification.Fields))
+		for key := range notification.Fields {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		section := teamsSection{}
+		for _, key := range keys {
+			section.Facts = append(section.Facts, teamsFact{Name: key, Value: notification.Fields[key]})
+		}
+
+		card.Sections = []teamsSection{section}
+	}
+
+	if notification.Url != "" {
+		card.Actions = []teamsAction{
+			teamsAction{
+				Type:    "OpenUri",
+				Name:    "View details",
+				Targets: []teamsTarget{teamsTarget{OS: "default", Uri: notification.Url}},
+			},
+		}
+	}
+
+	return postJSON(n.url, card, nil)
+}
+
+//
+// Helpers
+//
+
+func teamsColor(level string) string {
+	switch level {
+	case types.NotifyLevelSuccess:
+		return "2EB886"
+	case types.NotifyLevelWarning:
+		return "DAA038"
+	case types.NotifyLevelFailure:
+		return "A30200"
+	}
+
+	return ""
+}
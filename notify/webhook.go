@@ -0,0 +1,72 @@
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/ngmiller/fabrik/approval"
+	"github.com/ngmiller/fabrik/types"
+)
+
+// WebhookNotifier posts notifications as JSON to a URL. With a secret, requests are
+// signed the same way as approval webhooks.
+type WebhookNotifier struct {
+	url    string
+	secret string
+}
+
+func NewWebhookNotifier(url, secret string) *WebhookNotifier {
+	return &WebhookNotifier{url: url, secret: secret}
+}
+
+func (n *WebhookNotifier) Notify(notification types.Notification) error {
+	return postJSON(n.url, notification, func(req *http.Request, body []byte) {
+		if n.secret == "" {
+			return
+		}
+
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(approval.TimestampHeader, timestamp)
+		req.Header.Set(approval.SignatureHeader, approval.Sign(n.secret, timestamp, body))
+	})
+}
+
+//
+// Helpers
+//
+
+// postJSON posts a payload, letting the caller add headers (i.e. a signature) to the request.
+func postJSON(url string, payload interface{}, prepare func(req *http.Request, body []byte)) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if prepare != nil {
+		prepare(req, body)
+	}
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s responded %s", url, resp.Status)
+	}
+
+	return nil
+}
@@ -0,0 +1,70 @@
+package paths
+
+import (
+	"path"
+	"strings"
+)
+
+// Match reports whether name matches the shell pattern. Patterns follow the
+// syntax of path.Match, with the addition of a '**' segment, which matches
+// zero or more path segments, i.e. 'services/api/**'. A trailing '/' matches
+// the directory and everything in it, i.e. 'services/api/'.
+func Match(pattern, name string) bool {
+	if strings.HasSuffix(pattern, "/") {
+		pattern += "**"
+	}
+
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+// MatchAny reports whether any of the names match the patterns. Patterns apply in
+// order, and a pattern prefixed with '!' excludes the names it matches from those
+// matched so far, i.e. ['services/**', '!services/legacy/**'].
+func MatchAny(patterns, names []string) bool {
+	for _, name := range names {
+		if matchName(patterns, name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// matchName applies the patterns to a name in order, the last matching pattern deciding.
+func matchName(patterns []string, name string) bool {
+	matched := false
+	for _, pattern := range patterns {
+		negated := strings.HasPrefix(pattern, "!")
+		if Match(strings.TrimPrefix(pattern, "!"), name) {
+			matched = !negated
+		}
+	}
+
+	return matched
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+
+			return false
+		}
+
+		if len(name) == 0 {
+			return false
+		}
+
+		if ok, err := path.Match(pattern[0], name[0]); err != nil || !ok {
+			return false
+		}
+
+		pattern, name = pattern[1:], name[1:]
+	}
+
+	return len(name) == 0
+}
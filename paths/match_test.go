@@ -0,0 +1,62 @@
+package paths
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	cases := []struct {
+		pattern string
+		name    string
+		match   bool
+	}{
+		{"services/api/**", "services/api/main.go", true},
+		{"services/api/**", "services/api/handlers/v1/user.go", true},
+		{"services/api/**", "services/api", true},
+		{"services/api/**", "services/web/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "services/api/main.go", true},
+		{"**/*.go", "services/api/README.md", false},
+		{"services/**/test/*.json", "services/test/a.json", true},
+		{"services/**/test/*.json", "services/api/v1/test/a.json", true},
+		{"services/**/test/*.json", "services/api/v1/test/b/a.json", false},
+		{"**/*NOBUILD*/**", "feature/NOBUILD-docs", true},
+		{"**/*NOBUILD*/**", "feature/docs", false},
+		{"**/*NOBUILD*/**", "NOBUILD", true},
+		{"**/*NOBUILD*/**", "feature/wip-NOBUILD/docs", true},
+		{"services/api/", "services/api/main.go", true},
+		{"services/api/", "services/api/handlers/user.go", true},
+		{"services/api/", "services/apidocs/index.md", false},
+		{"*.md", "docs/README.md", false},
+		{"docs/*", "docs/guide/intro.md", false},
+		{"[", "[", false},
+	}
+
+	for _, c := range cases {
+		if got := Match(c.pattern, c.name); got != c.match {
+			t.Errorf("Match(%q, %q) = %v, want %v", c.pattern, c.name, got, c.match)
+		}
+	}
+}
+
+func TestMatchAny(t *testing.T) {
+	cases := []struct {
+		patterns []string
+		names    []string
+		match    bool
+	}{
+		{[]string{"services/**"}, []string{"README.md", "services/api/main.go"}, true},
+		{[]string{"services/**"}, []string{"README.md"}, false},
+		{[]string{"services/**"}, nil, false},
+		{nil, []string{"README.md"}, false},
+		{[]string{"services/**", "!services/legacy/**"}, []string{"services/legacy/main.go"}, false},
+		{[]string{"services/**", "!services/legacy/**"}, []string{"services/legacy/main.go", "services/api/main.go"}, true},
+		{[]string{"!services/legacy/**", "services/**"}, []string{"services/legacy/main.go"}, true},
+		{[]string{"services/**", "!services/legacy/**", "services/legacy/keep.go"}, []string{"services/legacy/keep.go"}, true},
+		{[]string{"!**/*.md"}, []string{"README.md"}, false},
+	}
+
+	for _, c := range cases {
+		if got := MatchAny(c.patterns, c.names); got != c.match {
+			t.Errorf("MatchAny(%q, %q) = %v, want %v", c.patterns, c.names, got, c.match)
+		}
+	}
+}
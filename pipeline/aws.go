@@ -2,58 +2,181 @@ package pipeline
 
 import (
 	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ngmiller/fabrik/types"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatchlogs"
+	"github.com/aws/aws-sdk-go/service/codebuild"
 	"github.com/aws/aws-sdk-go/service/codepipeline"
+	log "github.com/sirupsen/logrus"
 )
 
 type AWSPipelineManager struct {
+	log    *log.Entry
 	client *codepipeline.CodePipeline
+	build  *codebuild.CodeBuild
+	logs   *cloudwatchlogs.CloudWatchLogs
 }
 
-func NewAWSPipelineManager(session *session.Session) *AWSPipelineManager {
+func NewAWSPipelineManager(log *log.Entry, session *session.Session) *AWSPipelineManager {
 	return &AWSPipelineManager{
+		log:    log,
 		client: codepipeline.New(session),
+		build:  codebuild.New(session),
+		logs:   cloudwatchlogs.New(session),
 	}
 }
 
-func (m *AWSPipelineManager) GetRepoInfo(name string) (string, string, error) {
-	resp, err := m.client.GetPipeline(&codepipeline.GetPipelineInput{
+// GetSources returns the pipeline's GitHub source actions which provided a revision to
+// the execution. Sources are matched to the execution's revisions by output artifact.
+func (m *AWSPipelineManager) GetSources(execId, name string) ([]types.PipelineSource, error) {
+	pipeline, err := m.client.GetPipeline(&codepipeline.GetPipelineInput{
 		Name: aws.String(name),
 	})
 
 	if err != nil {
-		return "", "", err
+		return nil, err
 	}
 
-	action := resp.Pipeline.Stages[0].Actions[0]
-	provider := action.ActionTypeId.Provider
+	execution, err := m.client.GetPipelineExecution(&codepipeline.GetPipelineExecutionInput{
+		PipelineExecutionId: aws.String(execId),
+		PipelineName:        aws.String(name),
+	})
+
+	if err != nil {
+		return nil, err
+	}
 
-	// TODO: source provider is not guaranteed to GitHub in a generalized context
-	if *provider != "GitHub" {
-		return "", "", errors.New("source action provider is not GitHub")
+	// revisions by artifact name
+	revisions := make(map[string]*codepipeline.ArtifactRevision)
+	for _, revision := range execution.PipelineExecution.ArtifactRevisions {
+		revisions[aws.StringValue(revision.Name)] = revision
 	}
 
-	return *(action.Configuration["Owner"]), *(action.Configuration["Repo"]), nil
+	sources := make([]types.PipelineSource, 0)
+	for _, stage := range pipeline.Pipeline.Stages {
+		for _, action := range stage.Actions {
+			if aws.StringValue(action.ActionTypeId.Category) != codepipeline.ActionCategorySource {
+				continue
+			}
+
+			// only GitHub sources have a repository to report to
+			if provider := aws.StringValue(action.ActionTypeId.Provider); provider != "GitHub" {
+				m.log.Infoln("skipping source action", aws.StringValue(action.Name), "with provider", provider)
+				continue
+			}
+
+			for _, artifact := range action.OutputArtifacts {
+				revision, ok := revisions[aws.StringValue(artifact.Name)]
+				if !ok {
+					continue
+				}
+
+				sources = append(sources, types.PipelineSource{
+					Action:    aws.StringValue(action.Name),
+					Owner:     aws.StringValue(action.Configuration["Owner"]),
+					Repo:      aws.StringValue(action.Configuration["Repo"]),
+					Branch:    aws.StringValue(action.Configuration["Branch"]),
+					Revision:  aws.StringValue(revision.RevisionId),
+					Summary:   aws.StringValue(revision.RevisionSummary),
+					Committed: revision.Created,
+				})
+			}
+		}
+	}
+
+	if len(sources) == 0 {
+		return nil, errors.New("no GitHub source revisions found")
+	}
+
+	return sources, nil
 }
 
-func (m *AWSPipelineManager) GetRevision(execId, name string) (string, error) {
-	resp, err := m.client.GetPipelineExecution(&codepipeline.GetPipelineExecutionInput{
-		PipelineExecutionId: aws.String(execId),
-		PipelineName:        aws.String(name),
+// GetActionExecution returns the latest execution of a pipeline action. For CodeBuild actions,
+// the execution is supplemented with the build's timing, log link and failure messages.
+func (m *AWSPipelineManager) GetActionExecution(execId, name, stage, action string) (types.ActionExecution, error) {
+	resp, err := m.client.GetPipelineState(&codepipeline.GetPipelineStateInput{
+		Name: aws.String(name),
 	})
 
 	if err != nil {
-		return "", err
+		return types.ActionExecution{}, err
+	}
+
+	for _, stageState := range resp.StageStates {
+		if aws.StringValue(stageState.StageName) != stage {
+			continue
+		}
+
+		// the stage may have moved on to a newer pipeline execution
+		if stageState.LatestExecution != nil &&
+			aws.StringValue(stageState.LatestExecution.PipelineExecutionId) != execId {
+			return types.ActionExecution{}, fmt.Errorf("stage %s is running a newer execution", stage)
+		}
+
+		for _, actionState := range stageState.ActionStates {
+			if aws.StringValue(actionState.ActionName) != action || actionState.LatestExecution == nil {
+				continue
+			}
+
+			latest := actionState.LatestExecution
+			execution := types.ActionExecution{
+				Status:      aws.StringValue(latest.Status),
+				Summary:     aws.StringValue(latest.Summary),
+				ExternalId:  aws.StringValue(latest.ExternalExecutionId),
+				ExternalUrl: aws.StringValue(latest.ExternalExecutionUrl),
+			}
+
+			if latest.ErrorDetails != nil {
+				execution.ErrorMessage = aws.StringValue(latest.ErrorDetails.Message)
+			}
+
+			provider, err := m.actionProvider(name, stage, action)
+			if err != nil {
+				return execution, err
+			}
+
+			// CodeBuild execution ids are build ids
+			if provider == "CodeBuild" && execution.ExternalId != "" {
+				if err := m.buildDetails(&execution); err != nil {
+					return execution, err
+				}
+			}
+
+			return execution, nil
+		}
 	}
 
-	// Get the current revision
-	for _, revision := range resp.PipelineExecution.ArtifactRevisions {
-		return *(revision.RevisionId), nil
+	return types.ActionExecution{}, errors.New("action execution not found")
+}
+
+// GetBuildLog returns up to the last n lines of the execution's build log.
+func (m *AWSPipelineManager) GetBuildLog(execution types.ActionExecution, n int) ([]string, error) {
+	if execution.LogGroup == "" || execution.LogStream == "" {
+		return nil, errors.New("action execution has no build log")
 	}
 
-	return "", errors.New("revision not found")
+	resp, err := m.logs.GetLogEvents(&cloudwatchlogs.GetLogEventsInput{
+		LogGroupName:  aws.String(execution.LogGroup),
+		LogStreamName: aws.String(execution.LogStream),
+		Limit:         aws.Int64(int64(n)),
+		StartFromHead: aws.Bool(false),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	lines := make([]string, 0)
+	for _, event := range resp.Events {
+		lines = append(lines, strings.TrimRight(aws.StringValue(event.Message), "\n"))
+	}
+
+	return lines, nil
 }
 
 func (m *AWSPipelineManager) JobSuccess(id string) error {
@@ -75,3 +198,166 @@ func (m *AWSPipelineManager) JobFailure(id, message string) error {
 
 	return err
 }
+
+// GetApproval returns the pending manual approval action of an execution, with the token
+// required to approve or reject it.
+func (m *AWSPipelineManager) GetApproval(execId, name, stage, action string) (types.ApprovalRequest, error) {
+	request := types.ApprovalRequest{
+		Pipeline:    name,
+		ExecutionId: execId,
+		Stage:       stage,
+		Action:      action,
+	}
+
+	state, err := m.client.GetPipelineState(&codepipeline.GetPipelineStateInput{
+		Name: aws.String(name),
+	})
+
+	if err != nil {
+		return request, err
+	}
+
+	for _, stageState := range state.StageStates {
+		if aws.StringValue(stageState.StageName) != stage {
+			continue
+		}
+
+		if stageState.LatestExecution != nil &&
+			aws.StringValue(stageState.LatestExecution.PipelineExecutionId) != execId {
+			return request, fmt.Errorf("stage %s is running a newer execution", stage)
+		}
+
+		for _, actionState := range stageState.ActionStates {
+			if aws.StringValue(actionState.ActionName) == action && actionState.LatestExecution != nil {
+				request.Token = aws.StringValue(actionState.LatestExecution.Token)
+			}
+		}
+	}
+
+	if request.Token == "" {
+		return request, errors.New("approval token not found")
+	}
+
+	// optional message and review link, configured on the action
+	pipeline, err := m.client.GetPipeline(&codepipeline.GetPipelineInput{
+		Name: aws.String(name),
+	})
+
+	if err != nil {
+		return request, err
+	}
+
+	for _, stageDeclaration := range pipeline.Pipeline.Stages {
+		for _, actionDeclaration := range stageDeclaration.Actions {
+			if aws.StringValue(stageDeclaration.Name) == stage && aws.StringValue(actionDeclaration.Name) == action {
+				request.CustomData = aws.StringValue(actionDeclaration.Configuration["CustomData"])
+				request.ReviewUrl = aws.StringValue(actionDeclaration.Configuration["ExternalEntityLink"])
+			}
+		}
+	}
+
+	return request, nil
+}
+
+// PutApproval approves or rejects a manual approval action. The approver is recorded
+// in the result's summary.
+func (m *AWSPipelineManager) PutApproval(result types.ApprovalResult) error {
+	status := codepipeline.ApprovalStatusRejected
+	if result.Approved {
+		status = codepipeline.ApprovalStatusApproved
+	}
+
+	summary := fmt.Sprintf("%s by %s", status, result.Approver)
+	if result.Comment != "" {
+		summary += ": " + result.Comment
+	}
+
+	// summaries are limited to 512 characters
+	if len(summary) > 512 {
+		summary = summary[:509] + "..."
+	}
+
+	_, err := m.client.PutApprovalResult(&codepipeline.PutApprovalResultInput{
+		PipelineName: aws.String(result.Pipeline),
+		StageName:    aws.String(result.Stage),
+		ActionName:   aws.String(result.Action),
+		Token:        aws.String(result.Token),
+		Result: &codepipeline.ApprovalResult{
+			Status:  aws.String(status),
+			Summary: aws.String(summary),
+		},
+	})
+
+	return err
+}
+
+//
+// Helpers
+//
+
+// actionProvider returns the provider of an action, as declared in the pipeline
+func (m *AWSPipelineManager) actionProvider(name, stage, action string) (string, error) {
+	pipeline, err := m.client.GetPipeline(&codepipeline.GetPipelineInput{
+		Name: aws.String(name),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	for _, stageDeclaration := range pipeline.Pipeline.Stages {
+		if aws.StringValue(stageDeclaration.Name) != stage {
+			continue
+		}
+
+		for _, actionDeclaration := range stageDeclaration.Actions {
+			if aws.StringValue(actionDeclaration.Name) == action {
+				return aws.StringValue(actionDeclaration.ActionTypeId.Provider), nil
+			}
+		}
+	}
+
+	return "", fmt.Errorf("action %s not declared in stage %s", action, stage)
+}
+
+// buildDetails adds timing, log link and failed phase messages from the execution's build
+func (m *AWSPipelineManager) buildDetails(execution *types.ActionExecution) error {
+	resp, err := m.build.BatchGetBuilds(&codebuild.BatchGetBuildsInput{
+		Ids: aws.StringSlice([]string{execution.ExternalId}),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Builds) == 0 {
+		return nil
+	}
+
+	build := resp.Builds[0]
+	execution.Started = build.StartTime
+	execution.Finished = build.EndTime
+
+	if build.Logs != nil {
+		execution.LogUrl = aws.StringValue(build.Logs.DeepLink)
+		execution.LogGroup = aws.StringValue(build.Logs.GroupName)
+		execution.LogStream = aws.StringValue(build.Logs.StreamName)
+	}
+
+	// prefer the failing phase's message over the generic action error
+	for _, phase := range build.Phases {
+		status := aws.StringValue(phase.PhaseStatus)
+		if status == "" || status == codebuild.StatusTypeSucceeded || status == codebuild.StatusTypeInProgress {
+			continue
+		}
+
+		for _, context := range phase.Contexts {
+			if message := aws.StringValue(context.Message); message != "" {
+				execution.ErrorMessage = fmt.Sprintf("%s: %s", aws.StringValue(phase.PhaseType), message)
+				return nil
+			}
+		}
+	}
+
+	return nil
+}
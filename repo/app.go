@@ -0,0 +1,150 @@
+package repo
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+// ChecksEnabled reports whether results are reported with the Checks API, rather than
+// commit statuses. Checks require fabrik to be installed as a GitHub App.
+func ChecksEnabled() bool {
+	return os.Getenv("GITHUB_CHECKS") == "true"
+}
+
+// Token returns the token used for API requests on the repository, an app installation
+// token when checks are enabled, otherwise the given OAuth token.
+func Token(store types.SecureStore, oauthToken, owner, name string) (string, error) {
+	if !ChecksEnabled() {
+		return oauthToken, nil
+	}
+
+	appId, err := store.Get(types.KeyAppId)
+	if err != nil {
+		return "", err
+	}
+
+	key, err := store.Get(types.KeyAppKey)
+	if err != nil {
+		return "", err
+	}
+
+	return InstallationToken(appId, []byte(key), owner, name)
+}
+
+// InstallationToken exchanges a GitHub App's private key for a token scoped to the
+// app's installation on the given repository. Installation tokens are required by
+// the Checks API, and expire after one hour.
+func InstallationToken(appId string, privateKey []byte, owner, name string) (string, error) {
+	jwt, err := appJWT(appId, privateKey, time.Now())
+	if err != nil {
+		return "", err
+	}
+
+	// the app authenticates as itself to look up the installation
+	app := &GitHubRepository{
+		client: http.DefaultClient,
+		base:   "https://api.github.com",
+		owner:  owner,
+		name:   name,
+	}
+
+	var installation struct {
+		Id int64 `json:"id"`
+	}
+
+	lookup := fmt.Sprintf("%s/repos/%s/%s/installation", app.base, owner, name)
+	if err := app.appRequest(jwt, "GET", lookup, &installation); err != nil {
+		return "", err
+	}
+
+	var token struct {
+		Token string `json:"token"`
+	}
+
+	create := fmt.Sprintf("%s/app/installations/%d/access_tokens", app.base, installation.Id)
+	if err := app.appRequest(jwt, "POST", create, &token); err != nil {
+		return "", err
+	}
+
+	return token.Token, nil
+}
+
+//
+// Helpers
+//
+
+// appRequest makes a request authenticated as the app itself
+func (repo *GitHubRepository) appRequest(jwt, method, url string, out interface{}) error {
+	request, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", fmt.Sprintf("Bearer %s", jwt))
+	request.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	resp, err := repo.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error making request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error requesting %s %s: %s", method, url, resp.Status)
+	}
+
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// appJWT signs a short lived RS256 JSON web token identifying the app
+func appJWT(appId string, privateKey []byte, now time.Time) (string, error) {
+	block, _ := pem.Decode(privateKey)
+	if block == nil {
+		return "", errors.New("app private key is not PEM encoded")
+	}
+
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return "", fmt.Errorf("error parsing app private key: %s", err.Error())
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+
+	// backdate issue time to allow for clock drift, GitHub allows at most 10 minutes
+	claims, err := json.Marshal(map[string]interface{}{
+		"iat": now.Add(-time.Minute).Unix(),
+		"exp": now.Add(9 * time.Minute).Unix(),
+		"iss": appId,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	encoding := base64.RawURLEncoding
+	unsigned := encoding.EncodeToString(header) + "." + encoding.EncodeToString(claims)
+
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+
+	return unsigned + "." + encoding.EncodeToString(signature), nil
+}
@@ -6,8 +6,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/url"
 
 	"github.com/ngmiller/fabrik/types"
 
@@ -115,3 +117,182 @@ func (repo *GitHubRepository) Status(sha string, status types.GitHubStatus) erro
 
 	return nil
 }
+
+func (repo *GitHubRepository) DefaultBranch() (string, error) {
+	url := fmt.Sprintf("%s/repos/%s/%s", repo.base, repo.owner, repo.name)
+
+	request, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	request.Header.Set("Authorization", fmt.Sprintf("token %s", repo.token))
+
+	// make request
+	resp, err := repo.client.Do(request)
+	if err != nil {
+		return "", errors.New(fmt.Sprintf("error making request: %s", err.Error()))
+	}
+	defer resp.Body.Close()
+
+	// return error for non-200 status code
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New(fmt.Sprintf("error fetching repository: %s", resp.Status))
+	}
+
+	var parsed struct {
+		DefaultBranch string `json:"default_branch"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&parsed); err != nil {
+		return "", fmt.Errorf("error decoding json: %s", err.Error())
+	}
+
+	return parsed.DefaultBranch, nil
+}
+
+// Head returns the commit at the head of a branch.
+func (repo *GitHubRepository) Head(branch string) (string, error) {
+	var parsed struct {
+		Commit struct {
+			Sha string `json:"sha"`
+		} `json:"commit"`
+	}
+
+	url := fmt.Sprintf("%s/repos/%s/%s/branches/%s", repo.base, repo.owner, repo.name, url.PathEscape(branch))
+	if err := repo.request("GET", url, nil, &parsed); err != nil {
+		return "", err
+	}
+
+	return parsed.Commit.Sha, nil
+}
+
+// Check creates a check run on the commit, or updates the commit's existing run
+// of the same name.
+func (repo *GitHubRepository) Check(sha string, run types.GitHubCheckRun) error {
+	repo.log.Infoln("posting check run", run.Name, run.Status, run.Conclusion)
+
+	// find an existing run to update
+	var existing struct {
+		CheckRuns []struct {
+			Id int64 `json:"id"`
+		} `json:"check_runs"`
+	}
+
+	find := fmt.Sprintf(
+		"%s/repos/%s/%s/commits/%s/check-runs?check_name=%s",
+		repo.base, repo.owner, repo.name, sha, url.QueryEscape(run.Name),
+	)
+
+	if err := repo.request("GET", find, nil, &existing); err != nil {
+		return err
+	}
+
+	if len(existing.CheckRuns) > 0 {
+		update := fmt.Sprintf(
+			"%s/repos/%s/%s/check-runs/%d",
+			repo.base, repo.owner, repo.name, existing.CheckRuns[0].Id,
+		)
+
+		return repo.request("PATCH", update, run, nil)
+	}
+
+	run.HeadSha = sha
+	create := fmt.Sprintf("%s/repos/%s/%s/check-runs", repo.base, repo.owner, repo.name)
+
+	return repo.request("POST", create, run, nil)
+}
+
+// Deploy creates a deployment, returning its id.
+func (repo *GitHubRepository) Deploy(deployment types.GitHubDeployment) (int64, error) {
+	repo.log.Infoln("creating deployment", deployment.Environment)
+
+	if deployment.RequiredContexts == nil {
+		// skip commit status checks, fabrik's own statuses are still pending
+		deployment.RequiredContexts = []string{}
+	}
+
+	var created types.GitHubDeployment
+	url := fmt.Sprintf("%s/repos/%s/%s/deployments", repo.base, repo.owner, repo.name)
+
+	if err := repo.request("POST", url, deployment, &created); err != nil {
+		return 0, err
+	}
+
+	return created.Id, nil
+}
+
+// Deployments lists the deployments of a commit to an environment, newest first.
+// An empty environment lists deployments to every environment.
+func (repo *GitHubRepository) Deployments(sha, environment string) ([]types.GitHubDeployment, error) {
+	list := fmt.Sprintf(
+		"%s/repos/%s/%s/deployments?sha=%s&environment=%s",
+		repo.base, repo.owner, repo.name, sha, url.QueryEscape(environment),
+	)
+
+	if environment == "" {
+		list = fmt.Sprintf("%s/repos/%s/%s/deployments?sha=%s", repo.base, repo.owner, repo.name, sha)
+	}
+
+	deployments := make([]types.GitHubDeployment, 0)
+	if err := repo.request("GET", list, nil, &deployments); err != nil {
+		return nil, err
+	}
+
+	return deployments, nil
+}
+
+func (repo *GitHubRepository) DeploymentStatus(id int64, status types.GitHubDeploymentStatus) error {
+	repo.log.Infoln("posting deployment status", id, status.State)
+
+	url := fmt.Sprintf("%s/repos/%s/%s/deployments/%d/statuses", repo.base, repo.owner, repo.name, id)
+	return repo.request("POST", url, status, nil)
+}
+
+//
+// Helpers
+//
+
+// request makes an authenticated JSON request, encoding payload (if any) as the request
+// body and decoding the response into out (if any).
+func (repo *GitHubRepository) request(method, url string, payload, out interface{}) error {
+	var body io.Reader
+	if payload != nil {
+		encoded, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+
+		body = bytes.NewReader(encoded)
+	}
+
+	request, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return err
+	}
+
+	request.Header.Set("Authorization", fmt.Sprintf("token %s", repo.token))
+	request.Header.Set("Accept", "application/vnd.github.v3+json")
+
+	// make request
+	resp, err := repo.client.Do(request)
+	if err != nil {
+		return fmt.Errorf("error making request: %s", err.Error())
+	}
+	defer resp.Body.Close()
+
+	// return error for non-2xx status code
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("error requesting %s %s: %s", method, url, resp.Status)
+	}
+
+	if out == nil {
+		return nil
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("error decoding json: %s", err.Error())
+	}
+
+	return nil
+}
@@ -2,6 +2,7 @@ package secure
 
 import (
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ssm"
 )
@@ -26,3 +27,9 @@ func (store *AWSSecureStore) Get(key string) (string, error) {
 
 	return *(resp.Parameter.Value), nil
 }
+
+// NotFound reports whether an error from Get is due to a missing parameter.
+func NotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == ssm.ErrCodeParameterNotFound
+}
@@ -0,0 +1,136 @@
+package semver
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Pattern matches a semantic version, with an optional 'v' prefix (https://semver.org)
+var Pattern = regexp.MustCompile(
+	`^v?(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)\.(0|[1-9][0-9]*)` +
+		`(?:-((?:0|[1-9][0-9]*|[0-9]*[a-zA-Z-][0-9a-zA-Z-]*)(?:\.(?:0|[1-9][0-9]*|[0-9]*[a-zA-Z-][0-9a-zA-Z-]*))*))?` +
+		`(?:\+([0-9a-zA-Z-]+(?:\.[0-9a-zA-Z-]+)*))?$`)
+
+// Version is a parsed semantic version.
+type Version struct {
+	Major      int
+	Minor      int
+	Patch      int
+	PreRelease []string
+	Build      string
+}
+
+// Parse reads a semantic version, i.e. 'v1.4.0-rc.2+build.7'
+func Parse(version string) (Version, error) {
+	match := Pattern.FindStringSubmatch(version)
+	if match == nil {
+		return Version{}, fmt.Errorf("invalid semantic version %q", version)
+	}
+
+	var parsed Version
+	var err error
+
+	if parsed.Major, err = strconv.Atoi(match[1]); err != nil {
+		return Version{}, err
+	}
+
+	if parsed.Minor, err = strconv.Atoi(match[2]); err != nil {
+		return Version{}, err
+	}
+
+	if parsed.Patch, err = strconv.Atoi(match[3]); err != nil {
+		return Version{}, err
+	}
+
+	if match[4] != "" {
+		parsed.PreRelease = strings.Split(match[4], ".")
+	}
+
+	parsed.Build = match[5]
+	return parsed, nil
+}
+
+// IsPreRelease reports whether the version has pre-release identifiers, i.e. '-rc.1'
+func (v Version) IsPreRelease() bool {
+	return len(v.PreRelease) > 0
+}
+
+// String formats the version without a 'v' prefix.
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+
+	if v.IsPreRelease() {
+		s += "-" + strings.Join(v.PreRelease, ".")
+	}
+
+	if v.Build != "" {
+		s += "+" + v.Build
+	}
+
+	return s
+}
+
+// Compare returns -1, 0 or 1 if v has lower, equal or higher precedence than other.
+// Build metadata is ignored.
+func (v Version) Compare(other Version) int {
+	if c := compareInt(v.Major, other.Major); c != 0 {
+		return c
+	}
+
+	if c := compareInt(v.Minor, other.Minor); c != 0 {
+		return c
+	}
+
+	if c := compareInt(v.Patch, other.Patch); c != 0 {
+		return c
+	}
+
+	// a pre-release version has lower precedence than the release
+	if !v.IsPreRelease() || !other.IsPreRelease() {
+		return -compareInt(len(v.PreRelease), len(other.PreRelease))
+	}
+
+	for i := 0; i < len(v.PreRelease) && i < len(other.PreRelease); i++ {
+		if c := compareIdentifier(v.PreRelease[i], other.PreRelease[i]); c != 0 {
+			return c
+		}
+	}
+
+	return compareInt(len(v.PreRelease), len(other.PreRelease))
+}
+
+//
+// Helpers
+//
+
+func compareInt(a, b int) int {
+	if a < b {
+		return -1
+	}
+
+	if a > b {
+		return 1
+	}
+
+	return 0
+}
+
+// compareIdentifier compares pre-release identifiers. Numeric identifiers are compared
+// numerically and have lower precedence than alphanumeric identifiers.
+func compareIdentifier(a, b string) int {
+	an, aErr := strconv.Atoi(a)
+	bn, bErr := strconv.Atoi(b)
+
+	switch {
+	case aErr == nil && bErr == nil:
+		return compareInt(an, bn)
+	case aErr == nil:
+		return -1
+	case bErr == nil:
+		return 1
+	}
+
+	return strings.Compare(a, b)
+}
@@ -0,0 +1,149 @@
+package semver
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		version string
+		parsed  Version
+		valid   bool
+	}{
+		{"1.2.3", Version{Major: 1, Minor: 2, Patch: 3}, true},
+		{"v1.2.3", Version{Major: 1, Minor: 2, Patch: 3}, true},
+		{"v0.0.0", Version{}, true},
+		{"v10.20.30", Version{Major: 10, Minor: 20, Patch: 30}, true},
+		{"v1.4.0-rc.2", Version{Major: 1, Minor: 4, PreRelease: []string{"rc", "2"}}, true},
+		{"v1.4.0-rc.2+build.7", Version{Major: 1, Minor: 4, PreRelease: []string{"rc", "2"}, Build: "build.7"}, true},
+		{"v1.4.0+build.7", Version{Major: 1, Minor: 4, Build: "build.7"}, true},
+		{"v1.0.0-x-y.0a", Version{Major: 1, PreRelease: []string{"x-y", "0a"}}, true},
+		{"", Version{}, false},
+		{"v1", Version{}, false},
+		{"v1.2", Version{}, false},
+		{"1.2.3.4", Version{}, false},
+		{"V1.2.3", Version{}, false},
+		{"vv1.2.3", Version{}, false},
+		{"v01.2.3", Version{}, false},
+		{"v1.2.3-", Version{}, false},
+		{"v1.2.3-rc.01", Version{}, false},
+		{"v1.2.3-rc..1", Version{}, false},
+		{"v1.2.3+", Version{}, false},
+		{"release-1.2.3", Version{}, false},
+		{"v1.2.3 ", Version{}, false},
+	}
+
+	for _, c := range cases {
+		parsed, err := Parse(c.version)
+		if c.valid != (err == nil) {
+			t.Errorf("Parse(%q) error = %v, want valid %v", c.version, err, c.valid)
+			continue
+		}
+
+		if c.valid && !reflect.DeepEqual(parsed, c.parsed) {
+			t.Errorf("Parse(%q) = %+v, want %+v", c.version, parsed, c.parsed)
+		}
+	}
+}
+
+func TestString(t *testing.T) {
+	cases := map[string]string{
+		"v1.2.3":              "1.2.3",
+		"1.2.3-rc.1":          "1.2.3-rc.1",
+		"v1.4.0-rc.2+build.7": "1.4.0-rc.2+build.7",
+		"v1.4.0+build.7":      "1.4.0+build.7",
+	}
+
+	for version, expected := range cases {
+		parsed, err := Parse(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.String() != expected {
+			t.Errorf("Parse(%q).String() = %q, want %q", version, parsed.String(), expected)
+		}
+	}
+}
+
+func TestIsPreRelease(t *testing.T) {
+	cases := map[string]bool{
+		"v1.2.3":        false,
+		"v1.2.3+build1": false,
+		"v1.2.3-rc.1":   true,
+		"v1.2.3-0":      true,
+	}
+
+	for version, expected := range cases {
+		parsed, err := Parse(version)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if parsed.IsPreRelease() != expected {
+			t.Errorf("Parse(%q).IsPreRelease() = %v, want %v", version, parsed.IsPreRelease(), expected)
+		}
+	}
+}
+
+func TestCompare(t *testing.T) {
+	cases := []struct {
+		a, b     string
+		expected int
+	}{
+		// equal versions, build metadata and the 'v' prefix are ignored
+		{"1.2.3", "1.2.3", 0},
+		{"v1.2.3", "1.2.3", 0},
+		{"v1.2.3+build.1", "v1.2.3+build.2", 0},
+		{"v1.2.3-rc.1", "v1.2.3-rc.1", 0},
+
+		// numeric components compare numerically
+		{"v1.2.3", "v1.2.4", -1},
+		{"v1.2.10", "v1.2.9", 1},
+		{"v1.10.0", "v1.9.9", 1},
+		{"v2.0.0", "v1.99.99", 1},
+		{"v0.9.0", "v1.0.0", -1},
+
+		// pre-releases precede their release, but follow earlier releases
+		{"v1.0.0-rc.1", "v1.0.0", -1},
+		{"v1.0.0", "v1.0.0-rc.1", 1},
+		{"v1.0.0-rc.1", "v0.9.9", 1},
+		{"v1.0.1-alpha", "v1.0.0", 1},
+
+		// the ordering example from the specification
+		{"v1.0.0-alpha", "v1.0.0-alpha.1", -1},
+		{"v1.0.0-alpha.1", "v1.0.0-alpha.beta", -1},
+		{"v1.0.0-alpha.beta", "v1.0.0-beta", -1},
+		{"v1.0.0-beta", "v1.0.0-beta.2", -1},
+		{"v1.0.0-beta.2", "v1.0.0-beta.11", -1},
+		{"v1.0.0-beta.11", "v1.0.0-rc.1", -1},
+		{"v1.0.0-rc.1", "v1.0.0", -1},
+
+		// numeric identifiers compare numerically, and precede alphanumeric ones
+		{"v1.0.0-rc.10", "v1.0.0-rc.9", 1},
+		{"v1.0.0-1", "v1.0.0-alpha", -1},
+		{"v1.0.0-rc.1", "v1.0.0-rc.1.1", -1},
+	}
+
+	for _, c := range cases {
+		a, err := Parse(c.a)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		b, err := Parse(c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if result := a.Compare(b); result != c.expected {
+			t.Errorf("%s.Compare(%s) = %d, want %d", c.a, c.b, result, c.expected)
+		}
+
+		// comparisons are antisymmetric
+		if result := b.Compare(a); result != -c.expected {
+			t.Errorf("%s.Compare(%s) = %d, want %d", c.b, c.a, result, -c.expected)
+		}
+	}
+}
@@ -28,6 +28,9 @@ type AWSStackManager struct {
 	client   *cloudformation.CloudFormation
 	pipeline *codepipeline.CodePipeline
 	log      *log.Entry
+
+	// SNS topics notified of stack events
+	topics []string
 }
 
 func NewAWSStackManager(log *log.Entry, session *session.Session) *AWSStackManager {
@@ -38,15 +41,27 @@ func NewAWSStackManager(log *log.Entry, session *session.Session) *AWSStackManag
 	}
 }
 
+// WithTopic publishes the events of stacks created or updated by the manager to an SNS topic.
+// An empty topic is ignored.
+func (m *AWSStackManager) WithTopic(arn string) *AWSStackManager {
+	if arn != "" {
+		m.topics = append(m.topics, arn)
+	}
+
+	return m
+}
+
 func (m *AWSStackManager) Create(name string, parameters []types.Parameter, template []byte) error {
 	response, err := m.client.CreateStack(&cloudformation.CreateStackInput{
 		// Set IAM capabilities
 		Capabilities: aws.StringSlice([]string{"CAPABILITY_IAM", "CAPABILITY_NAMED_IAM"}),
 		// RoleARN - for ease of development, we are depending on the environment credentials,
 		// which are open to all actions
-		StackName:    aws.String(name),
-		TemplateBody: aws.String(string(template)),
-		Parameters:   mapParameters(parameters),
+		StackName:        aws.String(name),
+		TemplateBody:     aws.String(string(template)),
+		Parameters:       mapParameters(parameters),
+		Tags:             managedTags(),
+		NotificationARNs: m.notificationArns(),
 	})
 
 	if err != nil {
@@ -66,9 +81,11 @@ func (m *AWSStackManager) Update(name string, parameters []types.Parameter, temp
 		}),
 		// RoleARN - for ease of development, we are depending on the environment credentials,
 		// which are open to all actions
-		StackName:    aws.String(name),
-		TemplateBody: aws.String(string(template)),
-		Parameters:   mapParameters(parameters),
+		StackName:        aws.String(name),
+		TemplateBody:     aws.String(string(template)),
+		Parameters:       mapParameters(parameters),
+		Tags:             managedTags(),
+		NotificationARNs: m.notificationArns(),
 	})
 
 	if err != nil {
@@ -101,7 +118,7 @@ func (m *AWSStackManager) Delete(name string) error {
 	return nil
 }
 
-func (m *AWSStackManager) Status(name string) (bool, string, error) {
+func (m *AWSStackManager) Status(name string) (bool, types.StackStatus, error) {
 	response, err := m.client.DescribeStacks(&cloudformation.DescribeStacksInput{
 		StackName: aws.String(name),
 	})
@@ -111,14 +128,76 @@ func (m *AWSStackManager) Status(name string) (bool, string, error) {
 			return false, "", nil
 		}
 
-		return false, "ERROR", err
+		return false, "", err
 	}
 
 	if len(response.Stacks) == 0 {
 		return false, "", nil
 	}
 
-	return true, *(response.Stacks[0].StackStatus), nil
+	return true, types.StackStatus(aws.StringValue(response.Stacks[0].StackStatus)), nil
+}
+
+func (m *AWSStackManager) Parameters(name string) ([]types.Parameter, error) {
+	response, err := m.client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(name),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	parameters := make([]types.Parameter, 0)
+	for _, p := range response.Stacks[0].Parameters {
+		parameters = append(parameters, types.Parameter{
+			ParameterKey:   aws.StringValue(p.ParameterKey),
+			ParameterValue: aws.StringValue(p.ParameterValue),
+		})
+	}
+
+	return parameters, nil
+}
+
+// Outputs returns the stack's outputs, keyed by output name.
+func (m *AWSStackManager) Outputs(name string) (map[string]string, error) {
+	response, err := m.client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(name),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	outputs := make(map[string]string)
+	for _, o := range response.Stacks[0].Outputs {
+		outputs[aws.StringValue(o.OutputKey)] = aws.StringValue(o.OutputValue)
+	}
+
+	return outputs, nil
+}
+
+// Events returns the stack's most recent resource events, newest first.
+func (m *AWSStackManager) Events(name string) ([]types.StackEvent, error) {
+	response, err := m.client.DescribeStackEvents(&cloudformation.DescribeStackEventsInput{
+		StackName: aws.String(name),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]types.StackEvent, 0)
+	for _, e := range response.StackEvents {
+		events = append(events, types.StackEvent{
+			Timestamp:            aws.TimeValue(e.Timestamp),
+			LogicalResourceId:    aws.StringValue(e.LogicalResourceId),
+			ResourceType:         aws.StringValue(e.ResourceType),
+			ResourceStatus:       aws.StringValue(e.ResourceStatus),
+			ResourceStatusReason: aws.StringValue(e.ResourceStatusReason),
+		})
+	}
+
+	return events, nil
 }
 
 func (m *AWSStackManager) LastUpdated(name string) (*time.Time, error) {
@@ -146,8 +225,169 @@ func (m *AWSStackManager) StartBuild(name string) error {
 	return nil
 }
 
+// UpdateBuild points the stack's pipeline source at the given branch, by updating the
+// stack's RepoBranch parameter. The template and all other parameters are left as they are.
 func (m *AWSStackManager) UpdateBuild(name, ref string) error {
-	return errors.New("not implemented")
+	described, err := m.client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(name),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if len(described.Stacks) == 0 {
+		return errors.New("stack not found: " + name)
+	}
+
+	parameters := make([]*cloudformation.Parameter, 0)
+	for _, p := range described.Stacks[0].Parameters {
+		if *(p.ParameterKey) == types.ParameterRepoBranch {
+			continue
+		}
+
+		parameters = append(parameters, &cloudformation.Parameter{
+			ParameterKey:     p.ParameterKey,
+			UsePreviousValue: aws.Bool(true),
+		})
+	}
+
+	parameters = append(parameters, &cloudformation.Parameter{
+		ParameterKey:   aws.String(types.ParameterRepoBranch),
+		ParameterValue: aws.String(ref),
+	})
+
+	response, err := m.client.UpdateStack(&cloudformation.UpdateStackInput{
+		Capabilities: aws.StringSlice([]string{
+			cloudformation.CapabilityCapabilityIam,
+			cloudformation.CapabilityCapabilityNamedIam,
+		}),
+		StackName:           aws.String(name),
+		UsePreviousTemplate: aws.Bool(true),
+		Parameters:          parameters,
+	})
+
+	if err != nil {
+		if awsErr, ok := err.(awserr.Error); ok {
+			if awsErr.Code() == ErrValidationError {
+				if strings.Contains(awsErr.Message(), ErrNoUpdate) {
+					// source already points at ref, continue
+					return nil
+				}
+			}
+		}
+
+		return err
+	}
+
+	m.log.Infoln("cloudformation build update started:", *(response.StackId), ref)
+	return nil
+}
+
+// Template returns the template body a stack was last deployed with.
+func (m *AWSStackManager) Template(name string) ([]byte, error) {
+	resp, err := m.client.GetTemplate(&cloudformation.GetTemplateInput{
+		StackName:     aws.String(name),
+		TemplateStage: aws.String(cloudformation.TemplateStageOriginal),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return []byte(aws.StringValue(resp.TemplateBody)), nil
+}
+
+// TemplateParameters returns the names of the parameters a template declares.
+func (m *AWSStackManager) TemplateParameters(template []byte) ([]string, error) {
+	resp, err := m.client.ValidateTemplate(&cloudformation.ValidateTemplateInput{
+		TemplateBody: aws.String(string(template)),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(resp.Parameters))
+	for _, p := range resp.Parameters {
+		names = append(names, aws.StringValue(p.ParameterKey))
+	}
+
+	return names, nil
+}
+
+// Managed returns the names of the stacks tagged as managed by fabrik. Stacks are tagged
+// when they're created or updated by the builder.
+func (m *AWSStackManager) Managed() ([]string, error) {
+	names := make([]string, 0)
+	err := m.client.DescribeStacksPages(&cloudformation.DescribeStacksInput{},
+		func(page *cloudformation.DescribeStacksOutput, last bool) bool {
+			for _, s := range page.Stacks {
+				for _, tag := range s.Tags {
+					if aws.StringValue(tag.Key) == types.StackTagManaged {
+						names = append(names, aws.StringValue(s.StackName))
+						break
+					}
+				}
+			}
+
+			return true
+		})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return names, nil
+}
+
+// Owner returns the name of the root stack which created a resource, given its physical id
+// (i.e. an ECS service or task definition ARN), or empty if no stack owns the resource.
+func (m *AWSStackManager) Owner(physicalId string) (string, error) {
+	resources, err := m.client.DescribeStackResources(&cloudformation.DescribeStackResourcesInput{
+		PhysicalResourceId: aws.String(physicalId),
+	})
+
+	if err != nil {
+		if strings.Contains(err.Error(), ErrDoesNotExist) {
+			return "", nil
+		}
+
+		return "", err
+	}
+
+	if len(resources.StackResources) == 0 {
+		return "", nil
+	}
+
+	name := aws.StringValue(resources.StackResources[0].StackName)
+
+	// updates are cancelled on the root of nested stacks
+	stacks, err := m.client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: aws.String(name),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(stacks.Stacks) == 0 || stacks.Stacks[0].RootId == nil {
+		return name, nil
+	}
+
+	root, err := m.client.DescribeStacks(&cloudformation.DescribeStacksInput{
+		StackName: stacks.Stacks[0].RootId,
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	if len(root.Stacks) == 0 {
+		return name, nil
+	}
+
+	return aws.StringValue(root.Stacks[0].StackName), nil
 }
 
 func (m *AWSStackManager) CancelUpdate(name string) error {
@@ -158,6 +398,46 @@ func (m *AWSStackManager) CancelUpdate(name string) error {
 	return err
 }
 
+// ContinueRollback resumes the rollback of a stack in UPDATE_ROLLBACK_FAILED, skipping the
+// given resources, which are marked as rolled back without being changed.
+func (m *AWSStackManager) ContinueRollback(name string, skip []string) error {
+	input := &cloudformation.ContinueUpdateRollbackInput{
+		StackName: aws.String(name),
+	}
+
+	if len(skip) > 0 {
+		input.ResourcesToSkip = aws.StringSlice(skip)
+	}
+
+	if _, err := m.client.ContinueUpdateRollback(input); err != nil {
+		return err
+	}
+
+	m.log.Infoln("cloudformation stack rollback continued:", name)
+	return nil
+}
+
+// FailedResources returns the logical ids of the stack's resources which failed to update,
+// i.e. those blocking a rollback.
+func (m *AWSStackManager) FailedResources(name string) ([]string, error) {
+	response, err := m.client.DescribeStackResources(&cloudformation.DescribeStackResourcesInput{
+		StackName: aws.String(name),
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	failed := make([]string, 0)
+	for _, r := range response.StackResources {
+		if aws.StringValue(r.ResourceStatus) == types.ResourceStatusUpdateFailed {
+			failed = append(failed, aws.StringValue(r.LogicalResourceId))
+		}
+	}
+
+	return failed, nil
+}
+
 //
 // Helpers
 //
@@ -166,6 +446,15 @@ func (m *AWSStackManager) CancelUpdate(name string) error {
 func mapParameters(parameters []types.Parameter) []*cloudformation.Parameter {
 	returnParams := make([]*cloudformation.Parameter, 0)
 	for _, p := range parameters {
+		if p.UsePreviousValue {
+			returnParams = append(returnParams, &cloudformation.Parameter{
+				ParameterKey:     aws.String(p.ParameterKey),
+				UsePreviousValue: aws.Bool(true),
+			})
+
+			continue
+		}
+
 		returnParams = append(returnParams, &cloudformation.Parameter{
 			ParameterKey:   aws.String(p.ParameterKey),
 			ParameterValue: aws.String(p.ParameterValue),
@@ -174,3 +463,18 @@ func mapParameters(parameters []types.Parameter) []*cloudformation.Parameter {
 
 	return returnParams
 }
+
+func managedTags() []*cloudformation.Tag {
+	return []*cloudformation.Tag{
+		&cloudformation.Tag{Key: aws.String(types.StackTagManaged), Value: aws.String("true")},
+	}
+}
+
+// notificationArns returns the manager's topics, or nil to leave a stack's topics as they are.
+func (m *AWSStackManager) notificationArns() []*string {
+	if len(m.topics) == 0 {
+		return nil
+	}
+
+	return aws.StringSlice(m.topics)
+}
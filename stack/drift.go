@@ -0,0 +1,90 @@
+package stack
+
+import (
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// DetectDrift starts drift detection on the stack, returning the detection id.
+func (m *AWSStackManager) DetectDrift(name string) (string, error) {
+	output, err := m.client.DetectStackDrift(&cloudformation.DetectStackDriftInput{
+		StackName: aws.String(name),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	return aws.StringValue(output.StackDriftDetectionId), nil
+}
+
+// DriftDetection returns the status of a drift detection, and the stack's drift once complete.
+func (m *AWSStackManager) DriftDetection(id string) (types.DriftDetection, error) {
+	output, err := m.client.DescribeStackDriftDetectionStatus(&cloudformation.DescribeStackDriftDetectionStatusInput{
+		StackDriftDetectionId: aws.String(id),
+	})
+
+	if err != nil {
+		return types.DriftDetection{}, err
+	}
+
+	return types.DriftDetection{
+		Id:          id,
+		Stack:       aws.StringValue(output.StackId),
+		Status:      aws.StringValue(output.DetectionStatus),
+		Reason:      aws.StringValue(output.DetectionStatusReason),
+		DriftStatus: aws.StringValue(output.StackDriftStatus),
+		Drifted:     int(aws.Int64Value(output.DriftedStackResourceCount)),
+	}, nil
+}
+
+// ResourceDrifts returns the stack's resources which were modified or deleted, as of
+// the last drift detection.
+func (m *AWSStackManager) ResourceDrifts(name string) ([]types.ResourceDrift, error) {
+	input := &cloudformation.DescribeStackResourceDriftsInput{
+		StackName: aws.String(name),
+		StackResourceDriftStatusFilters: aws.StringSlice([]string{
+			types.DriftStatusModified,
+			types.DriftStatusDeleted,
+		}),
+	}
+
+	drifts := make([]types.ResourceDrift, 0)
+	for {
+		output, err := m.client.DescribeStackResourceDrifts(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, r := range output.StackResourceDrifts {
+			drift := types.ResourceDrift{
+				LogicalId:   aws.StringValue(r.LogicalResourceId),
+				PhysicalId:  aws.StringValue(r.PhysicalResourceId),
+				Type:        aws.StringValue(r.ResourceType),
+				Status:      aws.StringValue(r.StackResourceDriftStatus),
+				Differences: make([]types.PropertyDifference, 0, len(r.PropertyDifferences)),
+			}
+
+			for _, d := range r.PropertyDifferences {
+				drift.Differences = append(drift.Differences, types.PropertyDifference{
+					Path:     aws.StringValue(d.PropertyPath),
+					Type:     aws.StringValue(d.DifferenceType),
+					Expected: aws.StringValue(d.ExpectedValue),
+					Actual:   aws.StringValue(d.ActualValue),
+				})
+			}
+
+			drifts = append(drifts, drift)
+		}
+
+		if output.NextToken == nil {
+			break
+		}
+
+		input.NextToken = output.NextToken
+	}
+
+	return drifts, nil
+}
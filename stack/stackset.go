@@ -0,0 +1,273 @@
+package stack
+
+import (
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudformation"
+)
+
+// StackSetExists reports whether an active stack set exists. Deleted stack sets are
+// still described for a while.
+func (m *AWSStackManager) StackSetExists(name string) (bool, error) {
+	response, err := m.client.DescribeStackSet(&cloudformation.DescribeStackSetInput{
+		StackSetName: aws.String(name),
+	})
+
+	if err != nil {
+		if stackSetNotFound(err) {
+			return false, nil
+		}
+
+		return false, err
+	}
+
+	return aws.StringValue(response.StackSet.Status) == cloudformation.StackSetStatusActive, nil
+}
+
+// CreateStackSet creates a stack set without any instances.
+func (m *AWSStackManager) CreateStackSet(name string, parameters []types.Parameter, template []byte) error {
+	response, err := m.client.CreateStackSet(&cloudformation.CreateStackSetInput{
+		Capabilities: aws.StringSlice([]string{
+			cloudformation.CapabilityCapabilityIam,
+			cloudformation.CapabilityCapabilityNamedIam,
+		}),
+		StackSetName: aws.String(name),
+		TemplateBody: aws.String(string(template)),
+		Parameters:   mapParameters(parameters),
+		Tags:         managedTags(),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	m.log.Infoln("cloudformation stack set created:", aws.StringValue(response.StackSetId))
+	return nil
+}
+
+// UpdateStackSet updates a stack set and all of its instances, returning the operation id.
+func (m *AWSStackManager) UpdateStackSet(name string, parameters []types.Parameter, template []byte, config types.StackSetConfig) (string, error) {
+	response, err := m.client.UpdateStackSet(&cloudformation.UpdateStackSetInput{
+		Capabilities: aws.StringSlice([]string{
+			cloudformation.CapabilityCapabilityIam,
+			cloudformation.CapabilityCapabilityNamedIam,
+		}),
+		StackSetName:         aws.String(name),
+		TemplateBody:         aws.String(string(template)),
+		Parameters:           mapParameters(parameters),
+		Tags:                 managedTags(),
+		OperationPreferences: operationPreferences(config, nil),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	m.log.Infoln("cloudformation stack set update started:", name)
+	return aws.StringValue(response.OperationId), nil
+}
+
+// DeleteStackSet deletes a stack set, which must no longer have any instances.
+func (m *AWSStackManager) DeleteStackSet(name string) error {
+	_, err := m.client.DeleteStackSet(&cloudformation.DeleteStackSetInput{
+		StackSetName: aws.String(name),
+	})
+
+	if err != nil {
+		return err
+	}
+
+	m.log.Infoln("cloudformation stack set deleted:", name)
+	return nil
+}
+
+// StackInstances lists the instances of a stack set.
+func (m *AWSStackManager) StackInstances(name string) ([]types.StackInstance, error) {
+	instances := make([]types.StackInstance, 0)
+	input := &cloudformation.ListStackInstancesInput{
+		StackSetName: aws.String(name),
+	}
+
+	for {
+		response, err := m.client.ListStackInstances(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, summary := range response.Summaries {
+			instances = append(instances, types.StackInstance{
+				Account: aws.StringValue(summary.Account),
+				Region:  aws.StringValue(summary.Region),
+				Status:  aws.StringValue(summary.Status),
+				Reason:  aws.StringValue(summary.StatusReason),
+			})
+		}
+
+		if response.NextToken == nil {
+			return instances, nil
+		}
+
+		input.NextToken = response.NextToken
+	}
+}
+
+// CreateStackInstances creates an instance of a stack set in each of the accounts and
+// regions, returning the operation id.
+func (m *AWSStackManager) CreateStackInstances(name string, accounts, regions []string, config types.StackSetConfig) (string, error) {
+	response, err := m.client.CreateStackInstances(&cloudformation.CreateStackInstancesInput{
+		StackSetName:         aws.String(name),
+		Accounts:             aws.StringSlice(accounts),
+		Regions:              aws.StringSlice(regions),
+		OperationPreferences: operationPreferences(config, regions),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	m.log.Infoln("cloudformation stack instances create started:", name, accounts, regions)
+	return aws.StringValue(response.OperationId), nil
+}
+
+// DeleteStackInstances deletes the instances of a stack set in each of the accounts and
+// regions, along with their stacks, returning the operation id.
+func (m *AWSStackManager) DeleteStackInstances(name string, accounts, regions []string, config types.StackSetConfig) (string, error) {
+	response, err := m.client.DeleteStackInstances(&cloudformation.DeleteStackInstancesInput{
+		StackSetName:         aws.String(name),
+		Accounts:             aws.StringSlice(accounts),
+		Regions:              aws.StringSlice(regions),
+		OperationPreferences: operationPreferences(config, regions),
+		RetainStacks:         aws.Bool(false),
+	})
+
+	if err != nil {
+		return "", err
+	}
+
+	m.log.Infoln("cloudformation stack instances delete started:", name, accounts, regions)
+	return aws.StringValue(response.OperationId), nil
+}
+
+// StackSetOperation describes a stack set operation, with the result for each instance.
+func (m *AWSStackManager) StackSetOperation(name, id string) (types.StackSetOperation, error) {
+	response, err := m.client.DescribeStackSetOperation(&cloudformation.DescribeStackSetOperationInput{
+		StackSetName: aws.String(name),
+		OperationId:  aws.String(id),
+	})
+
+	if err != nil {
+		return types.StackSetOperation{}, err
+	}
+
+	operation := types.StackSetOperation{
+		Id:      id,
+		Action:  aws.StringValue(response.StackSetOperation.Action),
+		Status:  aws.StringValue(response.StackSetOperation.Status),
+		Created: aws.TimeValue(response.StackSetOperation.CreationTimestamp),
+	}
+
+	input := &cloudformation.ListStackSetOperationResultsInput{
+		StackSetName: aws.String(name),
+		OperationId:  aws.String(id),
+	}
+
+	for {
+		results, err := m.client.ListStackSetOperationResults(input)
+		if err != nil {
+			return operation, err
+		}
+
+		for _, summary := range results.Summaries {
+			operation.Results = append(operation.Results, types.StackInstance{
+				Account: aws.StringValue(summary.Account),
+				Region:  aws.StringValue(summary.Region),
+				Status:  aws.StringValue(summary.Status),
+				Reason:  aws.StringValue(summary.StatusReason),
+			})
+		}
+
+		if results.NextToken == nil {
+			return operation, nil
+		}
+
+		input.NextToken = results.NextToken
+	}
+}
+
+// LatestStackSetOperation returns the most recent operation on a stack set, without its
+// results, or nil if there's none.
+func (m *AWSStackManager) LatestStackSetOperation(name string) (*types.StackSetOperation, error) {
+	var latest *types.StackSetOperation
+	input := &cloudformation.ListStackSetOperationsInput{
+		StackSetName: aws.String(name),
+	}
+
+	for {
+		response, err := m.client.ListStackSetOperations(input)
+		if err != nil {
+			if stackSetNotFound(err) {
+				return nil, nil
+			}
+
+			return nil, err
+		}
+
+		for _, summary := range response.Summaries {
+			created := aws.TimeValue(summary.CreationTimestamp)
+			if latest != nil && !created.After(latest.Created) {
+				continue
+			}
+
+			latest = &types.StackSetOperation{
+				Id:      aws.StringValue(summary.OperationId),
+				Action:  aws.StringValue(summary.Action),
+				Status:  aws.StringValue(summary.Status),
+				Created: created,
+			}
+		}
+
+		if response.NextToken == nil {
+			return latest, nil
+		}
+
+		input.NextToken = response.NextToken
+	}
+}
+
+//
+// Helpers
+//
+
+// operationPreferences maps a stack set config to the preferences of an operation on the
+// given regions, leaving unset values to their defaults.
+func operationPreferences(config types.StackSetConfig, regions []string) *cloudformation.StackSetOperationPreferences {
+	preferences := &cloudformation.StackSetOperationPreferences{}
+	if len(regions) > 0 {
+		preferences.RegionOrder = aws.StringSlice(regions)
+	}
+
+	if config.FailureTolerance > 0 {
+		preferences.FailureToleranceCount = aws.Int64(config.FailureTolerance)
+	}
+
+	if config.FailureTolerancePercentage > 0 {
+		preferences.FailureTolerancePercentage = aws.Int64(config.FailureTolerancePercentage)
+	}
+
+	if config.MaxConcurrency > 0 {
+		preferences.MaxConcurrentCount = aws.Int64(config.MaxConcurrency)
+	}
+
+	if config.MaxConcurrencyPercentage > 0 {
+		preferences.MaxConcurrentPercentage = aws.Int64(config.MaxConcurrencyPercentage)
+	}
+
+	return preferences
+}
+
+func stackSetNotFound(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == cloudformation.ErrCodeStackSetNotFoundException
+}
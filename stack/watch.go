@@ -0,0 +1,49 @@
+package stack
+
+import (
+	"regexp"
+	"time"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+const (
+	// Bounds of the time between polls of a stack's status
+	PollIntervalMin = time.Second
+	PollIntervalMax = 30 * time.Second
+)
+
+var (
+	// Stack event notifications are lines of Key='value'
+	notificationField = regexp.MustCompile(`(?m)^(\w+)='([^']*)'$`)
+)
+
+// Backoff returns the time to wait before polling a stack again, after the given
+// number of polls, doubling from PollIntervalMin up to PollIntervalMax.
+func Backoff(polls int) time.Duration {
+	interval := PollIntervalMin
+	for i := 0; i < polls && interval < PollIntervalMax; i++ {
+		interval *= 2
+	}
+
+	if interval > PollIntervalMax {
+		return PollIntervalMax
+	}
+
+	return interval
+}
+
+// ParseNotification reads a stack event published by CloudFormation to an SNS topic.
+func ParseNotification(message string) types.StackNotification {
+	fields := make(map[string]string)
+	for _, match := range notificationField.FindAllStringSubmatch(message, -1) {
+		fields[match[1]] = match[2]
+	}
+
+	return types.StackNotification{
+		StackName:         fields["StackName"],
+		LogicalResourceId: fields["LogicalResourceId"],
+		ResourceType:      fields["ResourceType"],
+		ResourceStatus:    fields["ResourceStatus"],
+	}
+}
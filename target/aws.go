@@ -0,0 +1,142 @@
+package target
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+const (
+	// Name of the builder's sessions, as seen in the target account's CloudTrail
+	RoleSessionName = "fabrik"
+
+	// Buckets in us-east-1 are created without a location constraint
+	DefaultRegion = "us-east-1"
+)
+
+// Sessions caches a session per target, which assumes the target's role and refreshes
+// its credentials as they expire. Kept between invocations, a warm builder only assumes
+// each role once.
+type Sessions struct {
+	base     *session.Session
+	local    string
+	mu       sync.Mutex
+	sessions map[types.Target]*session.Session
+}
+
+// NewSessions creates a session cache, assuming roles with the base session. local is
+// the deployment account's artifact bucket, which target bucket names derive from.
+func NewSessions(base *session.Session, local string) *Sessions {
+	return &Sessions{
+		base:     base,
+		local:    local,
+		sessions: make(map[types.Target]*session.Session),
+	}
+}
+
+// Get returns the session for a target. The first time a target is requested, the
+// account its role assumes into is verified, and its artifact bucket is created
+// if it doesn't exist.
+func (s *Sessions) Get(target types.Target) (*session.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if sess, ok := s.sessions[target]; ok {
+		return sess, nil
+	}
+
+	creds := stscreds.NewCredentials(s.base, target.RoleArn, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = RoleSessionName
+		if target.ExternalId != "" {
+			p.ExternalID = aws.String(target.ExternalId)
+		}
+	})
+
+	sess := s.base.Copy(&aws.Config{
+		Credentials: creds,
+		Region:      aws.String(target.Region),
+	})
+
+	identity, err := sts.New(sess).GetCallerIdentity(&sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, fmt.Errorf("assume role %s: %s", target.RoleArn, err.Error())
+	}
+
+	if account := aws.StringValue(identity.Account); account != Account(target) {
+		return nil, fmt.Errorf("role %s assumed into account %s", target.RoleArn, account)
+	}
+
+	if err := ensureBucket(sess, ArtifactStore(target, s.local), target.Region); err != nil {
+		return nil, fmt.Errorf("artifact store: %s", err.Error())
+	}
+
+	s.sessions[target] = sess
+	return sess, nil
+}
+
+// Resolve returns the session for the target deploying to an account and region, or the
+// base session if there's none, i.e. for the deployment account's own stacks.
+func (s *Sessions) Resolve(targets map[string]types.Target, account, region string) (*session.Session, error) {
+	if deployTarget, ok := Find(targets, account, region); ok {
+		return s.Get(deployTarget)
+	}
+
+	return s.base, nil
+}
+
+//
+// Helpers
+//
+
+// ensureBucket creates a private, encrypted bucket in the session's account, unless
+// it already exists.
+func ensureBucket(sess *session.Session, bucket, region string) error {
+	client := s3.New(sess)
+
+	_, err := client.HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(bucket)})
+	if err == nil {
+		return nil
+	}
+
+	if aerr, ok := err.(awserr.Error); !ok || aerr.Code() != "NotFound" {
+		return err
+	}
+
+	input := &s3.CreateBucketInput{
+		ACL:    aws.String(s3.BucketCannedACLPrivate),
+		Bucket: aws.String(bucket),
+	}
+
+	if region != DefaultRegion {
+		input.CreateBucketConfiguration = &s3.CreateBucketConfiguration{
+			LocationConstraint: aws.String(region),
+		}
+	}
+
+	if _, err := client.CreateBucket(input); err != nil {
+		return err
+	}
+
+	_, err = client.PutBucketEncryption(&s3.PutBucketEncryptionInput{
+		Bucket: aws.String(bucket),
+		ServerSideEncryptionConfiguration: &s3.ServerSideEncryptionConfiguration{
+			Rules: []*s3.ServerSideEncryptionRule{
+				{
+					ApplyServerSideEncryptionByDefault: &s3.ServerSideEncryptionByDefault{
+						SSEAlgorithm: aws.String(s3.ServerSideEncryptionAes256),
+					},
+				},
+			},
+		},
+	})
+
+	return err
+}
@@ -0,0 +1,105 @@
+package target
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/ngmiller/fabrik/types"
+)
+
+var accountId = regexp.MustCompile(`^[0-9]{12}$`)
+
+// Load reads the deployment targets from the secure store, keyed by stage. Stages
+// without a target are deployed to the builder's own account and region.
+func Load(store types.SecureStore) (map[string]types.Target, error) {
+	raw, err := store.Get(types.KeyTargets)
+	if err != nil {
+		return nil, err
+	}
+
+	var targets map[string]types.Target
+	if err := json.Unmarshal([]byte(raw), &targets); err != nil {
+		return nil, fmt.Errorf("%s: %s", types.KeyTargets, err.Error())
+	}
+
+	for stage, target := range targets {
+		if err := validate(target); err != nil {
+			return nil, fmt.Errorf("%s: %s: %s", types.KeyTargets, stage, err.Error())
+		}
+	}
+
+	return targets, nil
+}
+
+// Find returns the target deployed to an account and region, if any.
+func Find(targets map[string]types.Target, account, region string) (types.Target, bool) {
+	for _, target := range targets {
+		if Account(target) == account && target.Region == region {
+			return target, true
+		}
+	}
+
+	return types.Target{}, false
+}
+
+// Account returns the ID of the account a target's role belongs to.
+func Account(target types.Target) string {
+	// arn:aws:iam::{account}:role/{name}
+	parts := strings.Split(target.RoleArn, ":")
+	if len(parts) != 6 {
+		return ""
+	}
+
+	return parts[4]
+}
+
+// ArtifactStore returns the name of a target's artifact bucket. Unless set, it's the
+// deployment account's bucket suffixed with the target's account and region, as bucket
+// names are global.
+func ArtifactStore(target types.Target, local string) string {
+	if target.ArtifactStore != "" {
+		return target.ArtifactStore
+	}
+
+	return fmt.Sprintf("%s-%s-%s", local, Account(target), target.Region)
+}
+
+// PipelineId identifies a pipeline in an account and region, i.e. as the external id of its
+// check runs: '{account}/{region}/{pipeline}'.
+func PipelineId(account, region, pipeline string) string {
+	return strings.Join([]string{account, region, pipeline}, "/")
+}
+
+// ParsePipelineId splits a pipeline id into its account, region and pipeline name. Ids which
+// are only a pipeline name are in the deployment account.
+func ParsePipelineId(id string) (string, string, string) {
+	parts := strings.SplitN(id, "/", 3)
+	if len(parts) != 3 {
+		return "", "", id
+	}
+
+	return parts[0], parts[1], parts[2]
+}
+
+//
+// Helpers
+//
+
+func validate(target types.Target) error {
+	if target.Region == "" {
+		return errors.New("region is required")
+	}
+
+	if !accountId.MatchString(Account(target)) {
+		return fmt.Errorf("invalid role_arn '%s'", target.RoleArn)
+	}
+
+	if target.AccountId != "" && target.AccountId != Account(target) {
+		return fmt.Errorf("role_arn '%s' doesn't belong to account %s", target.RoleArn, target.AccountId)
+	}
+
+	return nil
+}
@@ -1,7 +1,9 @@
 package types
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"regexp"
 	"time"
 )
@@ -11,39 +13,147 @@ const (
 	CloudFormationResponseSuccess = "SUCCESS"
 	CloudFormationResponseFailed  = "FAILED"
 
+	DeploymentStateError      = "error"
+	DeploymentStateFailure    = "failure"
+	DeploymentStateInProgress = "in_progress"
+	DeploymentStateInactive   = "inactive"
+	DeploymentStatePending    = "pending"
+	DeploymentStateSuccess    = "success"
+
 	DynamoDBEventInsert = "INSERT"
 
+	// Stack output read for a deployment's environment URL, unless configured otherwise
+	EnvironmentUrlOutput = "EnvironmentUrl"
+
 	EcsStateRunning  = "RUNNING"
 	EcsStateStopped  = "STOPPED"
 	EcsFailureReason = "Essential container in task exited"
+	EcsServiceGroup  = "service:"
+
+	EventTypeCheckRun = "check_run"
+	EventTypePush     = "push"
+
+	CheckActionRequested   = "requested_action"
+	CheckActionRerequested = "rerequested"
+	CheckActionRerun       = "rerun"
+
+	CheckStatusInProgress = "in_progress"
+	CheckStatusCompleted  = "completed"
+
+	CheckConclusionSuccess = "success"
+	CheckConclusionFailure = "failure"
+	CheckConclusionNeutral = "neutral"
+
+	CheckAnnotationFailure = "failure"
+	CheckAnnotationWarning = "warning"
+
+	FilterActionBuild = "build"
+	FilterActionSkip  = "skip"
+
+	GitContextPrep   = "fabrik/0-prep"
+	GitRefBranch     = "branch"
+	GitRefDefault    = "default"
+	GitRefPreRelease = "prerelease"
+	GitRefTag        = "tag"
+	GitTagPrefix     = "refs/tags/"
+	GitStateError    = "error"
+	GitStateFailure  = "failure"
+	GitStatePending  = "pending"
+	GitStateSuccess  = "success"
+
+	// Skipped builds are neutral check runs, and successful commit statuses, as the
+	// status API has no neutral state
+	GitStateSkipped = "skipped"
+
+	KeyAlertRules    = "fabrik.alert.rules"
+	KeyAppId         = "fabrik.github.app.id"
+	KeyAppKey        = "fabrik.github.app.key"
+	KeyHmac          = "fabrik.github.hmac"
+	KeyNotifyConfig  = "fabrik.notify.config"
+	KeyToken         = "fabrik.github.token"
+	KeySlackToken    = "fabrik.slack.token"
+	KeySlackSigning  = "fabrik.slack.signing"
+	KeyTargets       = "fabrik.targets"
+	KeyWebhookSecret = "fabrik.webhook.secret"
+
+	NotifyEventPrepSucceeded     = "prep.succeeded"
+	NotifyEventPrepFailed        = "prep.failed"
+	NotifyEventPipelineSucceeded = "pipeline.succeeded"
+	NotifyEventPipelineFailed    = "pipeline.failed"
+	NotifyEventPipelineCanceled  = "pipeline.canceled"
+	NotifyEventLog               = "log.event"
+	NotifyEventContainerFailed   = "container.failed"
+	NotifyEventStackDrifted      = "stack.drifted"
+
+	NotifyLevelInfo    = "info"
+	NotifyLevelSuccess = "success"
+	NotifyLevelWarning = "warning"
+	NotifyLevelFailure = "failure"
+
+	ParameterRepoBranch = "RepoBranch"
+	ParameterRepoToken  = "RepoToken"
+	ParameterStage      = "Stage"
+	ParameterVersion    = "Version"
 
-	EventTypePush = "push"
+	// CloudFormation's mask for NoEcho parameter values, also used for redacted parameters
+	ParameterMasked = "****"
 
-	GitContextPrep  = "fabrik/0-prep"
-	GitRefBranch    = "branch"
-	GitRefMaster    = "master"
-	GitRefTag       = "tag"
-	GitStateError   = "error"
-	GitStateFailure = "failure"
-	GitStatePending = "pending"
-	GitStateSuccess = "success"
+	PipelineCategoryApproval = "Approval"
 
-	KeyHmac  = "fabrik.github.hmac"
-	KeyToken = "fabrik.github.token"
+	PipelineDetailAction    = "CodePipeline Action Execution State Change"
+	PipelineDetailExecution = "CodePipeline Pipeline Execution State Change"
+	PipelineDetailStage     = "CodePipeline Stage Execution State Change"
 
-	PipelineStateStarted   = "STARTED"
-	PipelineStateResumed   = "RESUMED"
-	PipelineStateSucceeded = "SUCCEEDED"
-	PipelineStateFailed    = "FAILED"
+	PipelineStateStarted    = "STARTED"
+	PipelineStateResumed    = "RESUMED"
+	PipelineStateSucceeded  = "SUCCEEDED"
+	PipelineStateFailed     = "FAILED"
+	PipelineStateCanceled   = "CANCELED"
+	PipelineStateSuperseded = "SUPERSEDED"
+	PipelineStateStopping   = "STOPPING"
+	PipelineStateStopped    = "STOPPED"
+	PipelineStateAbandoned  = "ABANDONED"
+
+	ResourceStatusUpdateFailed = "UPDATE_FAILED"
+	ResourceTypeStack          = "AWS::CloudFormation::Stack"
+
+	// Tag marking the stacks created and updated by fabrik
+	StackTagManaged = "fabrik:managed"
+
+	StackSetOperationRunning   = "RUNNING"
+	StackSetOperationSucceeded = "SUCCEEDED"
+	StackSetOperationFailed    = "FAILED"
+	StackSetOperationStopping  = "STOPPING"
+	StackSetOperationStopped   = "STOPPED"
+
+	StackSetResultFailed    = "FAILED"
+	StackSetResultCancelled = "CANCELLED"
+
+	StackInstanceCurrent = "CURRENT"
+
+	DriftDetectionInProgress = "DETECTION_IN_PROGRESS"
+	DriftDetectionComplete   = "DETECTION_COMPLETE"
+	DriftDetectionFailed     = "DETECTION_FAILED"
+
+	DriftStatusDrifted  = "DRIFTED"
+	DriftStatusInSync   = "IN_SYNC"
+	DriftStatusModified = "MODIFIED"
+	DriftStatusDeleted  = "DELETED"
+
+	StageDevelopment   = "development"
+	StageStaging       = "staging"
+	StagePreProduction = "preproduction"
+	StageProduction    = "production"
 )
 
 var (
-	RegexTagRef = regexp.MustCompile(`v[0-9]+\.[0-9]+\.[0-9]+$`)
-
-	RegexCompleted  = regexp.MustCompile(`.*_COMPLETE`)
-	RegexInProgress = regexp.MustCompile(`.*_IN_PROGRESS`)
-	RegexFailed     = regexp.MustCompile(`.*_FAILED`)
-	RegexRollback   = regexp.MustCompile(`.*ROLLBACK.*`)
+	// ParameterManifestAliases maps alternate parameter manifest keys to the
+	// stage they represent. Earlier documentation keyed manifests by invocation
+	// type ('master', 'release') rather than stage.
+	ParameterManifestAliases = map[string]string{
+		"master":  StageStaging,
+		"release": StageProduction,
+	}
 )
 
 // Repository provides a means to fetch data from
@@ -51,6 +161,13 @@ var (
 type Repository interface {
 	Get(ref string, path string) ([]byte, error)
 	Status(sha string, status GitHubStatus) error
+	Check(sha string, run GitHubCheckRun) error
+	DefaultBranch() (string, error)
+	Head(branch string) (string, error)
+
+	Deploy(deployment GitHubDeployment) (int64, error)
+	Deployments(sha, environment string) ([]GitHubDeployment, error)
+	DeploymentStatus(id int64, status GitHubDeploymentStatus) error
 }
 
 // RepoNotFoundError - semantic type to represent '404' from a repo fetch
@@ -74,23 +191,110 @@ type StackManager interface {
 	Create(name string, parameters []Parameter, template []byte) error
 	Update(name string, parameters []Parameter, template []byte) error
 	Delete(name string) error
-	Status(name string) (bool, string, error)
+	Status(name string) (bool, StackStatus, error)
+	Parameters(name string) ([]Parameter, error)
+	Outputs(name string) (map[string]string, error)
+	Events(name string) ([]StackEvent, error)
 
+	Template(name string) ([]byte, error)
+	TemplateParameters(template []byte) ([]string, error)
 	LastUpdated(name string) (*time.Time, error)
+	Owner(physicalId string) (string, error)
+	Managed() ([]string, error)
+
+	DetectDrift(name string) (string, error)
+	DriftDetection(id string) (DriftDetection, error)
+	ResourceDrifts(name string) ([]ResourceDrift, error)
 
 	StartBuild(name string) error
 	UpdateBuild(name, ref string) error
 
 	CancelUpdate(name string) error
+	ContinueRollback(name string, skip []string) error
+	FailedResources(name string) ([]string, error)
+
+	StackSetExists(name string) (bool, error)
+	CreateStackSet(name string, parameters []Parameter, template []byte) error
+	UpdateStackSet(name string, parameters []Parameter, template []byte, config StackSetConfig) (string, error)
+	DeleteStackSet(name string) error
+	StackInstances(name string) ([]StackInstance, error)
+	CreateStackInstances(name string, accounts, regions []string, config StackSetConfig) (string, error)
+	DeleteStackInstances(name string, accounts, regions []string, config StackSetConfig) (string, error)
+	StackSetOperation(name, id string) (StackSetOperation, error)
+	LatestStackSetOperation(name string) (*StackSetOperation, error)
 }
 
 // PipelineManger provides a means of interacting with and querying
 // active CI/CD pipelines.
 type PipelineManager interface {
-	GetRepoInfo(name string) (string, string, error)
-	GetRevision(execId, name string) (string, error)
+	GetSources(execId, name string) ([]PipelineSource, error)
+	GetActionExecution(execId, name, stage, action string) (ActionExecution, error)
+	GetBuildLog(execution ActionExecution, lines int) ([]string, error)
 	JobSuccess(id string) error
 	JobFailure(id, message string) error
+
+	GetApproval(execId, name, stage, action string) (ApprovalRequest, error)
+	PutApproval(result ApprovalResult) error
+}
+
+// HistoryStore records pipeline executions, and the stages they ran, for reporting.
+type HistoryStore interface {
+	Record(execution PipelineExecution) error
+	RecordStage(id, repo string, stage StageExecution) error
+	Executions(repo, environment string, since time.Time) ([]PipelineExecution, error)
+}
+
+// DeploymentStore records the template and parameters each stack was successfully
+// deployed with. Deployments are listed without their template.
+type DeploymentStore interface {
+	Save(deployment Deployment) error
+	List(stack string) ([]Deployment, error)
+	Get(stack, id string) (Deployment, error)
+}
+
+// JobStore keeps the stacks a push is waiting on, after the builder's invocation ended,
+// until their operations end. Take removes a stack's job, returning nil if there's none.
+type JobStore interface {
+	Save(job StackJob) error
+	Take(stack string) (*StackJob, error)
+	Pending() ([]StackJob, error)
+}
+
+// DeliveryStore reads the GitHub events stored by the listener. Get returns nil for
+// deliveries which have expired.
+type DeliveryStore interface {
+	Get(id string) (*Delivery, error)
+}
+
+// DriftStore records the latest drift detected in each stack, and whether it was acknowledged.
+// Get returns nil for stacks which were never checked.
+type DriftStore interface {
+	Save(drift StackDrift) error
+	Get(stack string) (*StackDrift, error)
+	Acknowledge(stack, by string) error
+}
+
+// HealthChecker probes the resources of a deployed stack.
+type HealthChecker interface {
+	Endpoint(url string, status int) error
+	Alarms(names []string) ([]string, error)
+	ServiceStable(cluster, service string) (bool, error)
+}
+
+// ContainerManager inspects the services and task definitions running containers.
+type ContainerManager interface {
+	ServiceArn(cluster, name string) (string, error)
+	EssentialContainers(taskDefinition string) ([]string, error)
+}
+
+// Throttle limits how many times a key may be used within a window of time.
+type Throttle interface {
+	Allow(key string, limit int, window time.Duration) (bool, error)
+}
+
+// Notifier delivers notifications to people, i.e. a chat channel or a mailbox.
+type Notifier interface {
+	Notify(notification Notification) error
 }
 
 type LambdaManager interface {
@@ -128,19 +332,66 @@ type CloudFormationResponse struct {
 
 // GitHubEvent references relevant fields from the push event.
 type GitHubEvent struct {
-	Ref        string `json:"ref"`
-	Before     string `json:"before"`
-	After      string `json:"after"`
-	Created    bool   `json:"created"`
-	Deleted    bool   `json:"deleted"`
+	Ref        string           `json:"ref"`
+	BaseRef    string           `json:"base_ref"`
+	Before     string           `json:"before"`
+	After      string           `json:"after"`
+	Created    bool             `json:"created"`
+	Deleted    bool             `json:"deleted"`
+	Forced     bool             `json:"forced"`
+	Compare    string           `json:"compare"`
+	Commits    []GitHubCommit   `json:"commits"`
+	HeadCommit *GitHubCommit    `json:"head_commit"`
+	Pusher     GitHubCommitUser `json:"pusher"`
+	Sender     GitHubAccount    `json:"sender"`
 	Repository struct {
-		Name  string `json:"name"`
-		Owner struct {
-			Name string `json:"name"`
+		Id            int64  `json:"id"`
+		Name          string `json:"name"`
+		FullName      string `json:"full_name"`
+		DefaultBranch string `json:"default_branch"`
+		Private       bool   `json:"private"`
+		HtmlUrl       string `json:"html_url"`
+		CloneUrl      string `json:"clone_url"`
+		SshUrl        string `json:"ssh_url"`
+		Owner         struct {
+			Name  string `json:"name"`
+			Login string `json:"login"`
+			Email string `json:"email"`
 		} `json:"owner"`
 	} `json:"repository"`
 }
 
+// GitHubCommit references a commit included in a push event.
+type GitHubCommit struct {
+	Id        string           `json:"id"`
+	TreeId    string           `json:"tree_id"`
+	Message   string           `json:"message"`
+	Timestamp string           `json:"timestamp"`
+	Url       string           `json:"url"`
+	Distinct  bool             `json:"distinct"`
+	Author    GitHubCommitUser `json:"author"`
+	Committer GitHubCommitUser `json:"committer"`
+	Added     []string         `json:"added"`
+	Removed   []string         `json:"removed"`
+	Modified  []string         `json:"modified"`
+}
+
+// GitHubCommitUser identifies a commit author, committer, or pusher.
+// Username is only present when the email is associated with a GitHub account.
+type GitHubCommitUser struct {
+	Name     string `json:"name"`
+	Email    string `json:"email"`
+	Username string `json:"username"`
+}
+
+// GitHubAccount identifies the GitHub account that triggered an event.
+type GitHubAccount struct {
+	Id      int64  `json:"id"`
+	Login   string `json:"login"`
+	Type    string `json:"type"`
+	HtmlUrl string `json:"html_url"`
+}
+
 // GitHubStatus stores status context for a particular repo commit hash
 type GitHubStatus struct {
 	State       string `json:"state"`
@@ -149,28 +400,391 @@ type GitHubStatus struct {
 	Context     string `json:"context"`
 }
 
+// StatusDescription trims a message to the length accepted by the GitHub status API,
+// counted in characters rather than bytes so multi-byte characters aren't split.
+func StatusDescription(message string) string {
+	runes := []rune(message)
+	if len(runes) <= 140 {
+		return message
+	}
+
+	return string(runes[:137]) + "..."
+}
+
+// GitHubDeployment represents a deployment of a commit to an environment with the Deployments API.
+type GitHubDeployment struct {
+	Id                    int64             `json:"id,omitempty"`
+	Ref                   string            `json:"ref"`
+	Sha                   string            `json:"sha,omitempty"`
+	Task                  string            `json:"task,omitempty"`
+	Environment           string            `json:"environment"`
+	Description           string            `json:"description,omitempty"`
+	AutoMerge             bool              `json:"auto_merge"`
+	RequiredContexts      []string          `json:"required_contexts"`
+	ProductionEnvironment bool              `json:"production_environment"`
+	TransientEnvironment  bool              `json:"transient_environment"`
+	Payload               DeploymentPayload `json:"payload"`
+}
+
+// DeploymentPayload links a deployment to the stack being deployed.
+type DeploymentPayload struct {
+	Stack     string `json:"stack"`
+	UrlOutput string `json:"urlOutput"`
+}
+
+// GitHubDeploymentStatus reports the progress of a deployment.
+type GitHubDeploymentStatus struct {
+	State          string `json:"state"`
+	LogUrl         string `json:"log_url,omitempty"`
+	EnvironmentUrl string `json:"environment_url,omitempty"`
+	Description    string `json:"description,omitempty"`
+}
+
+// GitHubCheckRun represents a check run reported on a commit with the Checks API.
+type GitHubCheckRun struct {
+	Name        string              `json:"name"`
+	HeadSha     string              `json:"head_sha,omitempty"`
+	Status      string              `json:"status,omitempty"`
+	Conclusion  string              `json:"conclusion,omitempty"`
+	DetailsUrl  string              `json:"details_url,omitempty"`
+	ExternalId  string              `json:"external_id,omitempty"`
+	CompletedAt *time.Time          `json:"completed_at,omitempty"`
+	Output      *GitHubCheckOutput  `json:"output,omitempty"`
+	Actions     []GitHubCheckAction `json:"actions,omitempty"`
+}
+
+// GitHubCheckOutput is the markdown report attached to a check run.
+type GitHubCheckOutput struct {
+	Title       string                  `json:"title"`
+	Summary     string                  `json:"summary"`
+	Text        string                  `json:"text,omitempty"`
+	Annotations []GitHubCheckAnnotation `json:"annotations,omitempty"`
+}
+
+// GitHubCheckAnnotation points a check run message at a file in the repository.
+type GitHubCheckAnnotation struct {
+	Path            string `json:"path"`
+	StartLine       int    `json:"start_line"`
+	EndLine         int    `json:"end_line"`
+	AnnotationLevel string `json:"annotation_level"`
+	Title           string `json:"title,omitempty"`
+	Message         string `json:"message"`
+}
+
+// GitHubCheckAction is a button offered on a check run.
+type GitHubCheckAction struct {
+	Label       string `json:"label"`
+	Description string `json:"description"`
+	Identifier  string `json:"identifier"`
+}
+
+// GitHubCheckRunEvent references relevant fields from the check_run event.
+type GitHubCheckRunEvent struct {
+	Action   string `json:"action"`
+	CheckRun struct {
+		Id         int64  `json:"id"`
+		Name       string `json:"name"`
+		HeadSha    string `json:"head_sha"`
+		ExternalId string `json:"external_id"`
+	} `json:"check_run"`
+	RequestedAction struct {
+		Identifier string `json:"identifier"`
+	} `json:"requested_action"`
+	Repository struct {
+		Name  string `json:"name"`
+		Owner struct {
+			Login string `json:"login"`
+		} `json:"owner"`
+	} `json:"repository"`
+	Sender GitHubAccount `json:"sender"`
+}
+
+// CheckRun maps a commit status onto an equivalent check run.
+func (s GitHubStatus) CheckRun() GitHubCheckRun {
+	run := GitHubCheckRun{
+		Name:       s.Context,
+		Status:     CheckStatusInProgress,
+		DetailsUrl: s.TargetUrl,
+	}
+
+	if s.State != GitStatePending {
+		now := time.Now()
+		run.Status = CheckStatusCompleted
+		run.CompletedAt = &now
+		run.Conclusion = CheckConclusionFailure
+
+		if s.State == GitStateSuccess {
+			run.Conclusion = CheckConclusionSuccess
+		} else if s.State == GitStateError || s.State == GitStateSkipped {
+			// errors are runs that never finished, i.e. canceled or superseded, and
+			// skipped runs never started
+			run.Conclusion = CheckConclusionNeutral
+		}
+	}
+
+	if s.Description != "" {
+		run.Output = &GitHubCheckOutput{Title: s.Description, Summary: s.Description}
+	}
+
+	return run
+}
+
+// StackStatus is the status of a CloudFormation stack, i.e. the state of its last operation.
+type StackStatus string
+
+const (
+	StackStatusCreateInProgress                        StackStatus = "CREATE_IN_PROGRESS"
+	StackStatusCreateFailed                            StackStatus = "CREATE_FAILED"
+	StackStatusCreateComplete                          StackStatus = "CREATE_COMPLETE"
+	StackStatusRollbackInProgress                      StackStatus = "ROLLBACK_IN_PROGRESS"
+	StackStatusRollbackFailed                          StackStatus = "ROLLBACK_FAILED"
+	StackStatusRollbackComplete                        StackStatus = "ROLLBACK_COMPLETE"
+	StackStatusDeleteInProgress                        StackStatus = "DELETE_IN_PROGRESS"
+	StackStatusDeleteFailed                            StackStatus = "DELETE_FAILED"
+	StackStatusDeleteComplete                          StackStatus = "DELETE_COMPLETE"
+	StackStatusUpdateInProgress                        StackStatus = "UPDATE_IN_PROGRESS"
+	StackStatusUpdateCompleteCleanupInProgress         StackStatus = "UPDATE_COMPLETE_CLEANUP_IN_PROGRESS"
+	StackStatusUpdateComplete                          StackStatus = "UPDATE_COMPLETE"
+	StackStatusUpdateRollbackInProgress                StackStatus = "UPDATE_ROLLBACK_IN_PROGRESS"
+	StackStatusUpdateRollbackFailed                    StackStatus = "UPDATE_ROLLBACK_FAILED"
+	StackStatusUpdateRollbackCompleteCleanupInProgress StackStatus = "UPDATE_ROLLBACK_COMPLETE_CLEANUP_IN_PROGRESS"
+	StackStatusUpdateRollbackComplete                  StackStatus = "UPDATE_ROLLBACK_COMPLETE"
+	StackStatusReviewInProgress                        StackStatus = "REVIEW_IN_PROGRESS"
+)
+
+// IsTerminal reports whether no operation is running on the stack. Stacks in review
+// are waiting on a change set, which won't progress by itself.
+func (s StackStatus) IsTerminal() bool {
+	switch s {
+	case StackStatusCreateFailed, StackStatusCreateComplete,
+		StackStatusRollbackFailed, StackStatusRollbackComplete,
+		StackStatusDeleteFailed, StackStatusDeleteComplete,
+		StackStatusUpdateComplete,
+		StackStatusUpdateRollbackFailed, StackStatusUpdateRollbackComplete,
+		StackStatusReviewInProgress:
+		return true
+	}
+
+	return false
+}
+
+// IsSuccess reports whether the stack's last operation completed as requested.
+func (s StackStatus) IsSuccess() bool {
+	return s == StackStatusCreateComplete || s == StackStatusUpdateComplete || s == StackStatusDeleteComplete
+}
+
+// IsRollback reports whether the stack's last operation failed and is, or was, rolled back.
+func (s StackStatus) IsRollback() bool {
+	switch s {
+	case StackStatusRollbackInProgress, StackStatusRollbackFailed, StackStatusRollbackComplete,
+		StackStatusUpdateRollbackInProgress, StackStatusUpdateRollbackFailed,
+		StackStatusUpdateRollbackCompleteCleanupInProgress, StackStatusUpdateRollbackComplete:
+		return true
+	}
+
+	return false
+}
+
+// IsFailed reports whether the stack's last operation, or its rollback, failed.
+func (s StackStatus) IsFailed() bool {
+	switch s {
+	case StackStatusCreateFailed, StackStatusRollbackFailed, StackStatusDeleteFailed, StackStatusUpdateRollbackFailed:
+		return true
+	}
+
+	return false
+}
+
+// CanUpdate reports whether the stack accepts an update. Stacks which failed to create, or
+// to roll back, must be recovered first.
+func (s StackStatus) CanUpdate() bool {
+	return s == StackStatusCreateComplete || s == StackStatusUpdateComplete || s == StackStatusUpdateRollbackComplete
+}
+
+// StackJob is a service's stack operation, started by a push, which outlived the builder's
+// invocation. Payload is the push event, Deployment the GitHub deployment of the service.
+// Account and region are set for stacks of a deployment target.
+type StackJob struct {
+	Stack      string    `json:"stack"`
+	Service    string    `json:"service"`
+	Deployment int64     `json:"deployment"`
+	Payload    string    `json:"payload"`
+	Created    time.Time `json:"created"`
+	Account    string    `json:"account,omitempty"`
+	Region     string    `json:"region,omitempty"`
+}
+
+// Delivery is a GitHub event as stored by the listener, identified by its delivery id.
+type Delivery struct {
+	Id      string
+	Type    string
+	Payload string
+}
+
+// StackNotification is a stack event, as published by CloudFormation to a stack's
+// notification topics.
+type StackNotification struct {
+	StackName         string
+	LogicalResourceId string
+	ResourceType      string
+	ResourceStatus    string
+}
+
+// IsStack reports whether the event is for the stack itself, rather than one of its resources.
+func (n StackNotification) IsStack() bool {
+	return n.ResourceType == ResourceTypeStack && n.LogicalResourceId == n.StackName
+}
+
+// StackSetOperation is an operation on the instances of a stack set. Results holds the
+// outcome of each instance the operation covers.
+type StackSetOperation struct {
+	Id      string
+	Action  string
+	Status  string
+	Created time.Time
+	Results []StackInstance
+}
+
+// Done reports whether the operation has ended.
+func (o StackSetOperation) Done() bool {
+	return o.Status != StackSetOperationRunning && o.Status != StackSetOperationStopping
+}
+
+// Failed returns the instances the operation failed to deploy.
+func (o StackSetOperation) Failed() []StackInstance {
+	var failed []StackInstance
+	for _, result := range o.Results {
+		if result.Status == StackSetResultFailed || result.Status == StackSetResultCancelled {
+			failed = append(failed, result)
+		}
+	}
+
+	return failed
+}
+
+// StackInstance is a stack set's stack in an account and region. Status is the instance's
+// status, or its result within an operation.
+type StackInstance struct {
+	Account string
+	Region  string
+	Status  string
+	Reason  string
+}
+
+// StackEvent describes a change in state of a stack resource.
+type StackEvent struct {
+	Timestamp            time.Time
+	LogicalResourceId    string
+	ResourceType         string
+	ResourceStatus       string
+	ResourceStatusReason string
+}
+
 // ECSEvent
 type ECSEvent struct {
 	Containers []struct {
 		Name         string `json:"name"`
 		ContainerArn string `json:"containerArn"`
 		LastStatus   string `json:"lastStatus"`
+		ExitCode     *int   `json:"exitCode,omitempty"`
+		Reason       string `json:"reason,omitempty"`
 	} `json:"containers"`
-	StoppedReason string `json:"stoppedReason,omitempty"`
-	TaskArn       string `json:"taskArn"`
+	StoppedReason     string `json:"stoppedReason,omitempty"`
+	TaskArn           string `json:"taskArn"`
+	ClusterArn        string `json:"clusterArn"`
+	TaskDefinitionArn string `json:"taskDefinitionArn"`
+	Group             string `json:"group,omitempty"`
+	StartedBy         string `json:"startedBy,omitempty"`
 }
 
 // Parameter defines a common format for expressing stack parameters.
+// UsePreviousValue keeps the stack's current value on update, ignoring ParameterValue.
 type Parameter struct {
-	ParameterKey   string `json:"ParameterKey"`
-	ParameterValue string `json:"ParameterValue"`
+	ParameterKey     string `json:"ParameterKey"`
+	ParameterValue   string `json:"ParameterValue"`
+	UsePreviousValue bool   `json:"UsePreviousValue,omitempty"`
 }
 
 // ParameterManifest defines a common format for expressing a _set_ of stack parameters.
 type ParameterManifest struct {
-	Development []Parameter `json:"development"`
-	Staging     []Parameter `json:"staging"`
-	Production  []Parameter `json:"production"`
+	Development   []Parameter `json:"development"`
+	Staging       []Parameter `json:"staging"`
+	PreProduction []Parameter `json:"preproduction"`
+	Production    []Parameter `json:"production"`
+
+	// stages present in the decoded manifest
+	present map[string]bool
+}
+
+// UnmarshalJSON strictly decodes a parameter manifest. Unknown top-level keys and
+// parameter fields are rejected, and aliased keys are resolved to their stage.
+func (m *ParameterManifest) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	*m = ParameterManifest{present: make(map[string]bool)}
+
+	for key, value := range raw {
+		stage := key
+		if alias, ok := ParameterManifestAliases[key]; ok {
+			stage = alias
+		}
+
+		var target *[]Parameter
+		switch stage {
+		case StageDevelopment:
+			target = &m.Development
+		case StageStaging:
+			target = &m.Staging
+		case StagePreProduction:
+			target = &m.PreProduction
+		case StageProduction:
+			target = &m.Production
+		default:
+			return fmt.Errorf("parameter manifest: unknown key %q (expected %s, %s, %s or %s)",
+				key, StageDevelopment, StageStaging, StagePreProduction, StageProduction)
+		}
+
+		if m.present[stage] {
+			return fmt.Errorf("parameter manifest: duplicate parameters for %s (key %q)", stage, key)
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(value))
+		decoder.DisallowUnknownFields()
+
+		if err := decoder.Decode(target); err != nil {
+			return fmt.Errorf("parameter manifest: %s: %s", key, err.Error())
+		}
+
+		m.present[stage] = true
+	}
+
+	return nil
+}
+
+// Stage returns the parameter set for the given stage, or an error if the
+// manifest does not define one. Pre-production falls back to production parameters.
+func (m ParameterManifest) Stage(stage string) ([]Parameter, error) {
+	if stage == StagePreProduction && !m.present[stage] {
+		stage = StageProduction
+	}
+
+	if !m.present[stage] {
+		return nil, fmt.Errorf("parameter manifest: no parameters defined for %s", stage)
+	}
+
+	switch stage {
+	case StageStaging:
+		return m.Staging, nil
+	case StagePreProduction:
+		return m.PreProduction, nil
+	case StageProduction:
+		return m.Production, nil
+	}
+
+	return m.Development, nil
 }
 
 // PipelineStageDetail represents a stage change event metadata
@@ -181,3 +795,413 @@ type PipelineStageDetail struct {
 	Stage       string  `json:"stage"`
 	State       string  `json:"state"`
 }
+
+// RepoConfig lists the pipelines (services) defined in a repository.
+// Repositories without a config define a single pipeline at the repository root.
+type RepoConfig struct {
+	Services []ServiceConfig `json:"services"`
+	Filters  []BuildFilter   `json:"filters"`
+}
+
+// ServiceConfig locates a single pipeline within a repository.
+type ServiceConfig struct {
+	// Name identifies the service in logs and statuses
+	Name string `json:"name"`
+	// Pipeline is the path to the pipeline template
+	Pipeline string `json:"pipeline"`
+	// Parameters is the path to the parameter manifest
+	Parameters string `json:"parameters"`
+	// StackSuffix is appended to the stack name, defaults to Name
+	StackSuffix string `json:"stackSuffix"`
+	// Paths are patterns matched against changed files, an empty list matches every push
+	Paths []string `json:"paths"`
+	// EnvironmentUrlOutput is the stack output holding the deployed environment's URL
+	EnvironmentUrlOutput string `json:"environmentUrlOutput"`
+	// HealthCheck verifies the stack once it's updated, rolling back on failure
+	HealthCheck *HealthCheckConfig `json:"healthCheck"`
+	// BlockOnDrift refuses to update a stack with unacknowledged drift
+	BlockOnDrift bool `json:"blockOnDrift"`
+	// StackSet deploys the template as a stack set, rather than a stack and its pipeline
+	StackSet *StackSetConfig `json:"stackSet"`
+}
+
+// StackSetConfig defines the stack instances of a service deployed as a stack set, one in
+// each account and region listed. Operations roll out region by region, in the order listed.
+type StackSetConfig struct {
+	// Accounts and Regions the stack set has an instance in
+	Accounts []string `json:"accounts"`
+	Regions  []string `json:"regions"`
+	// FailureTolerance is the number of instances, per region, which may fail before the
+	// operation stops, or FailureTolerancePercentage the percentage of them
+	FailureTolerance           int64 `json:"failureTolerance"`
+	FailureTolerancePercentage int64 `json:"failureTolerancePercentage"`
+	// MaxConcurrency is the number of accounts deployed at once, or MaxConcurrencyPercentage
+	// the percentage of them, defaults to 1
+	MaxConcurrency           int64 `json:"maxConcurrency"`
+	MaxConcurrencyPercentage int64 `json:"maxConcurrencyPercentage"`
+}
+
+// HealthCheckConfig defines the checks a stack must pass after an update. The stack is
+// healthy once its endpoint responds and its ECS services are stable, as long as none
+// of its alarms fire. Resources generated by the stack are named by its outputs.
+type HealthCheckConfig struct {
+	// UrlOutput is the stack output holding the base URL of the endpoint
+	UrlOutput string `json:"urlOutput"`
+	// Path is requested from the base URL, i.e. '/health'
+	Path string `json:"path"`
+	// ExpectedStatus is the endpoint's healthy response status, defaults to 200
+	ExpectedStatus int `json:"expectedStatus"`
+	// Alarms are CloudWatch alarm names, AlarmOutputs are stack outputs holding them
+	Alarms       []string `json:"alarms"`
+	AlarmOutputs []string `json:"alarmOutputs"`
+	// ClusterOutput and ServiceOutputs are stack outputs holding ECS cluster and service names
+	ClusterOutput  string   `json:"clusterOutput"`
+	ServiceOutputs []string `json:"serviceOutputs"`
+	// Timeout is how long to wait for the stack to become healthy, defaults to '2m'
+	Timeout string `json:"timeout"`
+	// Rollback re-deploys the previous template and parameters on failure, defaults to true
+	Rollback *bool `json:"rollback"`
+}
+
+// BuildFilter skips or forces a build when all of its conditions match a push.
+// A filter without any conditions never matches.
+type BuildFilter struct {
+	// Action is either 'skip' or 'build'
+	Action string `json:"action"`
+	// Reason is reported in the commit status when the filter matches
+	Reason string `json:"reason"`
+	// Refs are patterns matched against the ref name, i.e. 'release/*'
+	Refs []string `json:"refs"`
+	// Paths match when any changed file matches one of the patterns
+	Paths []string `json:"paths"`
+	// OnlyPaths match when every changed file matches one of the patterns
+	OnlyPaths []string `json:"onlyPaths"`
+	// Message is a regular expression matched against the head commit message
+	Message string `json:"message"`
+	// Authors are matched against the head commit author's username, name or email
+	Authors []string `json:"authors"`
+}
+
+// Validate checks that each service is fully specified and distinct, filling
+// in defaults where possible.
+func (c *RepoConfig) Validate() error {
+	if len(c.Services) == 0 {
+		return fmt.Errorf("repo config: no services defined")
+	}
+
+	names := make(map[string]bool)
+	suffixes := make(map[string]bool)
+
+	for i := range c.Services {
+		service := &c.Services[i]
+
+		if service.Name == "" {
+			return fmt.Errorf("repo config: service %d has no name", i)
+		}
+
+		if service.Pipeline == "" {
+			return fmt.Errorf("repo config: service %s has no pipeline", service.Name)
+		}
+
+		if service.Parameters == "" {
+			return fmt.Errorf("repo config: service %s has no parameters", service.Name)
+		}
+
+		if service.StackSuffix == "" {
+			service.StackSuffix = service.Name
+		}
+
+		if service.EnvironmentUrlOutput == "" {
+			service.EnvironmentUrlOutput = EnvironmentUrlOutput
+		}
+
+		if names[service.Name] {
+			return fmt.Errorf("repo config: duplicate service %s", service.Name)
+		}
+
+		if suffixes[service.StackSuffix] {
+			return fmt.Errorf("repo config: duplicate stack suffix %s", service.StackSuffix)
+		}
+
+		if check := service.HealthCheck; check != nil {
+			if check.ExpectedStatus == 0 {
+				check.ExpectedStatus = 200
+			}
+
+			if check.Timeout == "" {
+				check.Timeout = "2m"
+			}
+
+			if _, err := time.ParseDuration(check.Timeout); err != nil {
+				return fmt.Errorf("repo config: service %s health check timeout: %s", service.Name, err.Error())
+			}
+
+			if len(check.ServiceOutputs) > 0 && check.ClusterOutput == "" {
+				return fmt.Errorf("repo config: service %s health check services require a clusterOutput", service.Name)
+			}
+		}
+
+		if set := service.StackSet; set != nil {
+			if len(set.Accounts) == 0 || len(set.Regions) == 0 {
+				return fmt.Errorf("repo config: service %s stack set requires accounts and regions", service.Name)
+			}
+
+			if service.HealthCheck != nil {
+				return fmt.Errorf("repo config: service %s health checks aren't supported for stack sets", service.Name)
+			}
+
+			if set.FailureTolerance != 0 && set.FailureTolerancePercentage != 0 {
+				return fmt.Errorf("repo config: service %s stack set has both failureTolerance and failureTolerancePercentage", service.Name)
+			}
+
+			if set.MaxConcurrency != 0 && set.MaxConcurrencyPercentage != 0 {
+				return fmt.Errorf("repo config: service %s stack set has both maxConcurrency and maxConcurrencyPercentage", service.Name)
+			}
+
+			if set.FailureTolerancePercentage > 100 || set.MaxConcurrencyPercentage > 100 {
+				return fmt.Errorf("repo config: service %s stack set percentages can't exceed 100", service.Name)
+			}
+
+			if set.MaxConcurrency == 0 && set.MaxConcurrencyPercentage == 0 {
+				set.MaxConcurrency = 1
+			}
+		}
+
+		names[service.Name] = true
+		suffixes[service.StackSuffix] = true
+	}
+
+	for i, filter := range c.Filters {
+		if filter.Action != FilterActionSkip && filter.Action != FilterActionBuild {
+			return fmt.Errorf("repo config: filter %d has unknown action %q", i, filter.Action)
+		}
+
+		if _, err := regexp.Compile(filter.Message); err != nil {
+			return fmt.Errorf("repo config: filter %d message: %s", i, err.Error())
+		}
+	}
+
+	return nil
+}
+
+// PipelineActionDetail represents an action change event metadata
+type PipelineActionDetail struct {
+	Version     float32 `json:"version"`
+	Pipeline    string  `json:"pipeline"`
+	ExecutionId string  `json:"execution-id"`
+	Stage       string  `json:"stage"`
+	Action      string  `json:"action"`
+	State       string  `json:"state"`
+	Type        struct {
+		Owner    string `json:"owner"`
+		Category string `json:"category"`
+		Provider string `json:"provider"`
+		Version  string `json:"version"`
+	} `json:"type"`
+}
+
+// PipelineSource is a GitHub source action of a pipeline, and the revision
+// it provided to a pipeline execution.
+type PipelineSource struct {
+	Action   string `json:"action"`
+	Owner    string `json:"owner"`
+	Repo     string `json:"repo"`
+	Branch   string `json:"branch"`
+	Revision string `json:"revision"`
+
+	// commit message and time of the revision
+	Summary   string     `json:"summary,omitempty"`
+	Committed *time.Time `json:"committed,omitempty"`
+}
+
+// Notification is a message about an event, routed by its event type, repository
+// ('owner/name') and environment (stage). Repository and environment are empty for
+// events outside of a pipeline.
+type Notification struct {
+	Event       string            `json:"event"`
+	Level       string            `json:"level"`
+	Repo        string            `json:"repo,omitempty"`
+	Environment string            `json:"environment,omitempty"`
+	Title       string            `json:"title"`
+	Text        string            `json:"text,omitempty"`
+	Url         string            `json:"url,omitempty"`
+	Fields      map[string]string `json:"fields,omitempty"`
+}
+
+// ApprovalRequest describes a pending manual approval action, and the changes awaiting it.
+// Account and region are those of the pipeline, which are passed back with the result.
+type ApprovalRequest struct {
+	Pipeline    string `json:"pipeline"`
+	ExecutionId string `json:"execution_id"`
+	Stage       string `json:"stage"`
+	Action      string `json:"action"`
+	Token       string `json:"token"`
+	Account     string `json:"account,omitempty"`
+	Region      string `json:"region,omitempty"`
+
+	// from the action's configuration
+	CustomData string `json:"custom_data,omitempty"`
+	ReviewUrl  string `json:"review_url,omitempty"`
+
+	Sources []PipelineSource `json:"sources,omitempty"`
+}
+
+// ApprovalResult approves or rejects a manual approval action.
+type ApprovalResult struct {
+	Pipeline string `json:"pipeline"`
+	Stage    string `json:"stage"`
+	Action   string `json:"action"`
+	Token    string `json:"token"`
+	Account  string `json:"account,omitempty"`
+	Region   string `json:"region,omitempty"`
+	Approved bool   `json:"approved"`
+	Approver string `json:"approver"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// ActionExecution describes the latest execution of a pipeline action.
+// Timing and log details are only available for actions backed by a build.
+type ActionExecution struct {
+	Status       string
+	Summary      string
+	ErrorMessage string
+	ExternalId   string
+	ExternalUrl  string
+	LogUrl       string
+	LogGroup     string
+	LogStream    string
+	Started      *time.Time
+	Finished     *time.Time
+}
+
+// Deployment is a snapshot of a stack as it was successfully deployed, from a commit.
+// Secret parameter values are redacted.
+type Deployment struct {
+	Id         string      `json:"id"`
+	Stack      string      `json:"stack"`
+	Repo       string      `json:"repo"`
+	Ref        string      `json:"ref"`
+	Commit     string      `json:"commit"`
+	Deployed   time.Time   `json:"deployed"`
+	Account    string      `json:"account,omitempty"`
+	Region     string      `json:"region,omitempty"`
+	Parameters []Parameter `json:"parameters"`
+	Template   []byte      `json:"-"`
+}
+
+// Target is an account and region which a stage's stacks are deployed to, through
+// an assumed role. ArtifactStore is the target region's artifact bucket, which defaults
+// to the deployment account's bucket name suffixed with the region.
+type Target struct {
+	AccountId     string `json:"account_id"`
+	Region        string `json:"region"`
+	RoleArn       string `json:"role_arn"`
+	ExternalId    string `json:"external_id"`
+	ArtifactStore string `json:"artifact_store"`
+}
+
+// DriftDetection is the progress, and result, of a stack drift detection.
+type DriftDetection struct {
+	Id          string
+	Stack       string
+	Status      string
+	Reason      string
+	DriftStatus string
+	Drifted     int
+}
+
+// StackDrift is the drift last detected in a stack. Acknowledged holds who accepted
+// the drift, and is kept until different drift is detected.
+type StackDrift struct {
+	Stack        string          `json:"stack"`
+	Status       string          `json:"status"`
+	Detected     time.Time       `json:"detected"`
+	Resources    []ResourceDrift `json:"resources"`
+	Fingerprint  string          `json:"fingerprint"`
+	Acknowledged string          `json:"acknowledged,omitempty"`
+}
+
+// Blocking reports whether the drift should prevent the stack from being updated.
+func (d StackDrift) Blocking() bool {
+	return d.Status == DriftStatusDrifted && d.Acknowledged == ""
+}
+
+// ResourceDrift is a stack resource which no longer matches its template.
+type ResourceDrift struct {
+	LogicalId   string               `json:"logical_id"`
+	PhysicalId  string               `json:"physical_id"`
+	Type        string               `json:"type"`
+	Status      string               `json:"status"`
+	Differences []PropertyDifference `json:"differences,omitempty"`
+}
+
+// PropertyDifference is a resource property which differs from its template.
+type PropertyDifference struct {
+	Path     string `json:"path"`
+	Type     string `json:"type"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+}
+
+// PipelineExecution is the recorded history of a pipeline execution, as seen by one
+// of its source repositories. Unknown times are nil.
+type PipelineExecution struct {
+	Id          string
+	Pipeline    string
+	Repo        string
+	Ref         string
+	Commit      string
+	Environment string
+	State       string
+	Committed   *time.Time
+	Started     *time.Time
+	Finished    *time.Time
+	Stages      []StageExecution
+}
+
+// Duration returns the time taken by a finished execution, or zero.
+func (e PipelineExecution) Duration() time.Duration {
+	if e.Started == nil || e.Finished == nil {
+		return 0
+	}
+
+	return e.Finished.Sub(*(e.Started))
+}
+
+// LeadTime returns the time from commit to the end of a finished execution, or zero.
+func (e PipelineExecution) LeadTime() time.Duration {
+	if e.Committed == nil || e.Finished == nil {
+		return 0
+	}
+
+	return e.Finished.Sub(*(e.Committed))
+}
+
+// StageExecution is the recorded history of a pipeline stage within an execution.
+type StageExecution struct {
+	Name     string
+	State    string
+	Started  *time.Time
+	Finished *time.Time
+}
+
+// PipelineMetrics summarizes the executions of a repository's pipelines in an environment.
+// Rates and means only consider executions which ran to success or failure.
+type PipelineMetrics struct {
+	Repo         string  `json:"repo"`
+	Environment  string  `json:"environment"`
+	Executions   int     `json:"executions"`
+	Succeeded    int     `json:"succeeded"`
+	Failed       int     `json:"failed"`
+	FailureRate  float64 `json:"failure_rate"`
+	MeanDuration string  `json:"mean_duration"`
+	MeanLeadTime string  `json:"mean_lead_time"`
+}
+
+// PipelineExecutionDetail represents a pipeline execution change event metadata
+type PipelineExecutionDetail struct {
+	Version     float32 `json:"version"`
+	Pipeline    string  `json:"pipeline"`
+	ExecutionId string  `json:"execution-id"`
+	State       string  `json:"state"`
+}
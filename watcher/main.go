@@ -0,0 +1,186 @@
+package main
+
+import (
+	"os"
+
+	"github.com/ngmiller/fabrik/job"
+	"github.com/ngmiller/fabrik/lambda"
+	"github.com/ngmiller/fabrik/secure"
+	"github.com/ngmiller/fabrik/stack"
+	"github.com/ngmiller/fabrik/target"
+	"github.com/ngmiller/fabrik/types"
+
+	"github.com/aws/aws-lambda-go/events"
+	awsLambda "github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Assumed role sessions of the deployment targets, kept while the function is warm
+var targetSessions *target.Sessions
+
+func init() {
+	log.SetFormatter(&log.JSONFormatter{DisableTimestamp: true})
+}
+
+func main() {
+	awsLambda.Start(Handler)
+}
+
+// Handler receives the stack events CloudFormation publishes for stacks created or updated by
+// the builder, and resumes the builder's jobs once their stacks' operations end. Scheduled
+// invocations carry no records, and sweep for jobs whose events were missed.
+func Handler(event events.SNSEvent) error {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Errorln("recovered from panic:", r)
+		}
+	}()
+
+	// AWS session
+	sess := session.Must(session.NewSession())
+	store := job.NewAWSJobStore(sess, os.Getenv("JOB_TABLE"))
+	lambdaManager := lambda.NewAWSLambdaManager(sess)
+	builder := os.Getenv("BUILDER_FUNCTION")
+
+	if len(event.Records) == 0 {
+		log := log.WithField("sweep", true)
+
+		// stacks of deployment targets are read through the target's role
+		targets, err := target.Load(secure.NewAWSSecureStore(sess))
+		if err != nil && !secure.NotFound(err) {
+			log.Errorln("error loading deployment targets:", err.Error())
+			return nil
+		}
+
+		if targetSessions == nil {
+			targetSessions = target.NewSessions(sess, os.Getenv("ARTIFACT_STORE"))
+		}
+
+		managers := func(account, region string) (types.StackManager, error) {
+			stackSession, err := targetSessions.Resolve(targets, account, region)
+			if err != nil {
+				return nil, err
+			}
+
+			return stack.NewAWSStackManager(log, stackSession), nil
+		}
+
+		if err := Sweep(log, store, managers, lambdaManager, builder); err != nil {
+			log.Errorln("error sweeping jobs:", err.Error())
+		}
+
+		return nil
+	}
+
+	for _, record := range event.Records {
+		notification := stack.ParseNotification(record.SNS.Message)
+
+		log := log.WithField("stack", notification.StackName)
+		if err := Process(log, store, lambdaManager, builder, notification); err != nil {
+			log.Errorln("error resuming job:", err.Error())
+		}
+	}
+
+	return nil
+}
+
+// Process resumes the job waiting on a stack once the stack's operation ends.
+func Process(log *log.Entry, store types.JobStore, invoker types.LambdaManager, builder string, notification types.StackNotification) error {
+	// resource events are published as well
+	if !notification.IsStack() {
+		return nil
+	}
+
+	status := types.StackStatus(notification.ResourceStatus)
+	if !status.IsTerminal() {
+		return nil
+	}
+
+	pending, err := store.Take(notification.StackName)
+	if err != nil {
+		return err
+	}
+
+	if pending == nil {
+		log.Infoln("stack status", status, "- no job waiting, no action")
+		return nil
+	}
+
+	log.Infoln("stack status", status, "- resuming", pending.Service)
+	return resume(invoker, builder, *pending)
+}
+
+// Sweep resumes the jobs whose stacks' operations ended, or which no longer exist, in case
+// their events were missed. Stacks created before the builder published their events
+// have no topic to publish to until their next update. Stack sets, and the stacks of
+// deployment targets, publish no events, so their jobs are only resumed here, once their
+// latest operation ends.
+func Sweep(log *log.Entry, store types.JobStore, managers func(account, region string) (types.StackManager, error), invoker types.LambdaManager, builder string) error {
+	jobs, err := store.Pending()
+	if err != nil {
+		return err
+	}
+
+	for _, waiting := range jobs {
+		manager, err := managers(waiting.Account, waiting.Region)
+		if err != nil {
+			log.Warnln("could not prepare deployment target:", waiting.Stack, err.Error())
+			continue
+		}
+
+		exists, status, err := manager.Status(waiting.Stack)
+		if err != nil {
+			log.Warnln("could not get stack status:", waiting.Stack, err.Error())
+			continue
+		}
+
+		if exists && !status.IsTerminal() {
+			continue
+		}
+
+		// stack sets publish no events, their jobs wait on the latest operation
+		if !exists {
+			operation, err := manager.LatestStackSetOperation(waiting.Stack)
+			if err != nil {
+				log.Warnln("could not get stack set operation:", waiting.Stack, err.Error())
+				continue
+			}
+
+			if operation != nil && !operation.Done() {
+				continue
+			}
+		}
+
+		pending, err := store.Take(waiting.Stack)
+		if err != nil {
+			return err
+		}
+
+		// resumed by its event in the meantime
+		if pending == nil {
+			continue
+		}
+
+		log.Infoln("stack", waiting.Stack, "status", status, "- resuming", pending.Service)
+		if err := resume(invoker, builder, *pending); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+//
+// Helpers
+//
+
+func resume(invoker types.LambdaManager, builder string, pending types.StackJob) error {
+	event, err := job.ResumeEvent([]types.StackJob{pending})
+	if err != nil {
+		return err
+	}
+
+	return invoker.Invoke(builder, event)
+}